@@ -0,0 +1,201 @@
+package diecast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/ghetzel/go-stockutil/stringutil"
+	base58 "github.com/jbenet/go-base58"
+	"github.com/urfave/negroni"
+)
+
+// The header used to return (and forward) the ID of each request.
+var RequestIdHeader = `X-Request-Id`
+
+// Request IDs supplied by clients (e.g.: a load balancer) are only used if they look like this.
+var rxValidRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type AccessLogConfig struct {
+	Format string `json:"format"` // "combined" (Apache combined log format) or "json"; if empty, requests are logged normally
+	Path   string `json:"path"`   // file to append access log lines to (default: standard output)
+}
+
+// Details about a request that are collected as it is handled, then written to the access log.
+type accessLogEntry struct {
+	RequestID string
+	Route     string
+	Mount     string
+	Template  string
+	User      string
+}
+
+// Returns the access log entry for the given request, which can be used to record details about how
+// it was handled.
+func requestLog(req *http.Request) *accessLogEntry {
+	if req != nil {
+		if entry, ok := req.Context().Value(`diecast-request-log`).(*accessLogEntry); ok {
+			return entry
+		}
+	}
+
+	return new(accessLogEntry)
+}
+
+// Open the access log file (if one was configured).
+func (self *Server) openAccessLog() error {
+	if self.accessLog != nil {
+		return nil
+	}
+
+	switch self.AccessLog.Format {
+	case ``, `combined`, `json`:
+	default:
+		return fmt.Errorf("unknown access log format %q", self.AccessLog.Format)
+	}
+
+	if self.AccessLog.Path == `` || self.AccessLog.Path == `-` {
+		self.accessLog = os.Stdout
+	} else if file, err := os.OpenFile(self.AccessLog.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+		self.accessLog = file
+	} else {
+		return err
+	}
+
+	return nil
+}
+
+// Middleware that assigns each request an ID (returning it in a response header), and writes an access
+// log entry once the request has been handled.
+func (self *Server) logRequests(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	started := time.Now()
+	requestId := req.Header.Get(RequestIdHeader)
+
+	if !rxValidRequestId.MatchString(requestId) {
+		requestId = base58.Encode(stringutil.UUID().Bytes())
+	}
+
+	entry := &accessLogEntry{
+		RequestID: requestId,
+	}
+
+	ctx := context.WithValue(req.Context(), `diecast-request-id`, requestId)
+	ctx = context.WithValue(ctx, `diecast-request-log`, entry)
+	ctx = context.WithValue(ctx, `diecast-metrics`, self.metricsRegistry())
+	*req = *req.WithContext(ctx)
+
+	w.Header().Set(RequestIdHeader, requestId)
+
+	next(w, req)
+
+	var status, size int
+
+	if rw, ok := w.(negroni.ResponseWriter); ok {
+		status = rw.Status()
+		size = rw.Size()
+	}
+
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	took := time.Since(started)
+
+	self.writeAccessLog(req, entry, status, size, took)
+	self.observeRequest(status, entry, took)
+}
+
+func (self *Server) writeAccessLog(req *http.Request, entry *accessLogEntry, status int, size int, took time.Duration) {
+	var line string
+
+	switch self.AccessLog.Format {
+	case `combined`:
+		line = combinedLogLine(req, entry, status, size, took)
+	case `json`:
+		if data, err := json.Marshal(map[string]interface{}{
+			`time`:        time.Now().Format(time.RFC3339Nano),
+			`request_id`:  entry.RequestID,
+			`remote_addr`: remoteHost(req),
+			`user`:        entry.User,
+			`method`:      req.Method,
+			`host`:        req.Host,
+			`uri`:         req.RequestURI,
+			`protocol`:    req.Proto,
+			`status`:      status,
+			`bytes`:       size,
+			`duration_ms`: float64(took) / float64(time.Millisecond),
+			`referer`:     req.Referer(),
+			`user_agent`:  req.UserAgent(),
+			`mount`:       entry.Mount,
+			`template`:    entry.Template,
+		}); err == nil {
+			line = string(data)
+		} else {
+			log.Warningf("Failed to encode access log entry: %v", err)
+			return
+		}
+	default:
+		log.Infof("%v %v %d %dB %v [%s]", req.Method, req.URL, status, size, took, entry.RequestID)
+		return
+	}
+
+	self.accessLogLock.Lock()
+	defer self.accessLogLock.Unlock()
+
+	if self.accessLog != nil {
+		io.WriteString(self.accessLog, line+"\n")
+	}
+}
+
+// Format a line in the Apache combined log format, followed by the request ID and how long the request
+// took (in milliseconds).
+func combinedLogLine(req *http.Request, entry *accessLogEntry, status int, size int, took time.Duration) string {
+	user := `-`
+	bytes := `-`
+
+	if entry.User != `` {
+		user = entry.User
+	}
+
+	if size > 0 {
+		bytes = fmt.Sprintf("%d", size)
+	}
+
+	return fmt.Sprintf(
+		"%s - %s [%s] %q %d %s %q %q %q %.3f",
+		remoteHost(req),
+		user,
+		time.Now().Format(`02/Jan/2006:15:04:05 -0700`),
+		fmt.Sprintf("%s %s %s", req.Method, req.RequestURI, req.Proto),
+		status,
+		bytes,
+		dashIfEmpty(req.Referer()),
+		dashIfEmpty(req.UserAgent()),
+		entry.RequestID,
+		float64(took)/float64(time.Millisecond),
+	)
+}
+
+func remoteHost(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+
+	return dashIfEmpty(req.RemoteAddr)
+}
+
+func dashIfEmpty(value string) string {
+	if strings.TrimSpace(value) == `` {
+		return `-`
+	}
+
+	return value
+}
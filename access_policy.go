@@ -0,0 +1,119 @@
+package diecast
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ghetzel/go-stockutil/log"
+)
+
+// Addresses that may access protected internal endpoints when a policy doesn't specify any (and
+// doesn't require authentication).
+var DefaultAccessAllow = []string{`127.0.0.0/8`, `::1/128`}
+
+// Controls which clients may access an internal endpoint.
+type AccessPolicy struct {
+	Allow            []string `json:"allow"`            // client addresses or CIDR ranges (e.g.: "10.0.0.0/8") that are permitted
+	AllowUnixSockets bool     `json:"allowUnixSockets"` // permit requests arriving over Unix sockets, which have no client address
+	Authenticate     bool     `json:"authenticate"`     // require requests to pass the authenticator configured for the endpoint's path
+}
+
+// Verify that all addresses in the policy are valid.
+func (self *AccessPolicy) Validate() error {
+	for _, allow := range self.Allow {
+		if _, err := parseNetwork(allow); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns whether the client that made the given request is in one of the permitted address ranges.
+// Requests arriving over Unix sockets (often from a reverse proxy, on behalf of any client) are only
+// permitted if AllowUnixSockets is set.
+func (self *AccessPolicy) AllowsAddress(req *http.Request) bool {
+	host := req.RemoteAddr
+
+	if h, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		host = h
+	}
+
+	if host == `` || host == `@` || strings.HasPrefix(host, `/`) {
+		return self.AllowUnixSockets
+	}
+
+	allow := self.Allow
+
+	if len(allow) == 0 {
+		if self.Authenticate {
+			return true
+		}
+
+		allow = DefaultAccessAllow
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, entry := range allow {
+		if network, err := parseNetwork(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else {
+			log.Warningf("access policy: %v", err)
+		}
+	}
+
+	return false
+}
+
+// Check whether the given request may access an endpoint protected by this policy.  If not, an error
+// (or an authentication challenge) has already been written to the response.
+func (self *AccessPolicy) permit(server *Server, w http.ResponseWriter, req *http.Request) bool {
+	if !self.AllowsAddress(req) {
+		http.Error(w, fmt.Sprintf("Access to %q is not permitted.", req.URL.Path), http.StatusForbidden)
+		return false
+	}
+
+	if self.Authenticate {
+		if auth, err := server.Authenticators.Authenticator(req); err == nil {
+			if auth == nil {
+				http.Error(w, fmt.Sprintf("Access to %q requires authentication.", req.URL.Path), http.StatusForbidden)
+				return false
+			} else if !server.authenticate(auth, w, req) {
+				return false
+			}
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parse an IP address or CIDR range.  Bare addresses match only themselves.
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, `/`) {
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			return network, nil
+		} else {
+			return nil, fmt.Errorf("invalid address range %q", value)
+		}
+	} else if ip := net.ParseIP(value); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	} else {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+}
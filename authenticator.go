@@ -15,6 +15,12 @@ type Authenticator interface {
 	Callback(w http.ResponseWriter, req *http.Request)
 }
 
+// Authenticators implementing UserIdentifier can name who an authenticated request was made by.  This
+// is recorded in the access log, and used by rate limits applied per user.
+type UserIdentifier interface {
+	User(*http.Request) string
+}
+
 type AuthenticatorConfig struct {
 	Type         string                 `json:"type"`
 	Paths        []string               `json:"paths"`
@@ -98,6 +104,36 @@ func (self AuthenticatorConfigs) isUrlMatch(auth *AuthenticatorConfig, u *url.UR
 	return true
 }
 
+// Run the given authenticator against a request, recording the outcome.
+func (self *Server) authenticate(auth Authenticator, w http.ResponseWriter, req *http.Request) bool {
+	if auth.Authenticate(w, req) {
+		if identifier, ok := auth.(UserIdentifier); ok {
+			requestLog(req).User = identifier.User(req)
+		}
+
+		self.observeAuthentication(auth, `success`)
+		return true
+	}
+
+	self.observeAuthentication(auth, `failure`)
+	return false
+}
+
+func (self *Server) observeAuthentication(auth Authenticator, outcome string) {
+	var authType string
+
+	switch auth.(type) {
+	case *BasicAuthenticator:
+		authType = `basic`
+	case *OauthAuthenticator:
+		authType = `oauth2`
+	default:
+		authType = fmt.Sprintf("%T", auth)
+	}
+
+	self.metricsRegistry().authentications.Add(1, authType, outcome)
+}
+
 func returnAuthenticatorFor(auth *AuthenticatorConfig) (Authenticator, error) {
 	var authenticator Authenticator
 	var err error
@@ -63,6 +63,17 @@ func (self *BasicAuthenticator) Callback(w http.ResponseWriter, req *http.Reques
 
 }
 
+func (self *BasicAuthenticator) User(req *http.Request) string {
+	if _, uppair := stringutil.SplitPair(req.Header.Get("Authorization"), ` `); uppair != `` {
+		if decoded, err := base64.StdEncoding.DecodeString(uppair); err == nil {
+			username, _ := stringutil.SplitPair(string(decoded), `:`)
+			return username
+		}
+	}
+
+	return ``
+}
+
 func (self *BasicAuthenticator) Authenticate(w http.ResponseWriter, req *http.Request) bool {
 	if _, uppair := stringutil.SplitPair(req.Header.Get("Authorization"), ` `); uppair != `` {
 		if decoded, err := base64.StdEncoding.DecodeString(uppair); err == nil {
@@ -1,6 +1,8 @@
 package diecast
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -157,6 +159,21 @@ func (self *OauthAuthenticator) Callback(w http.ResponseWriter, req *http.Reques
 	}
 }
 
+// Identifies users by their session.  The session ID is as good as a password, so only a digest of
+// it is used.
+func (self *OauthAuthenticator) User(req *http.Request) string {
+	if cookie, err := req.Cookie(self.cookieName); err == nil {
+		if sessionI, ok := oauthSessions.Load(cookie.Value); ok {
+			if session, ok := sessionI.(*oauthSession); ok && session.Token != nil {
+				sum := sha256.Sum256([]byte(session.State))
+				return `session:` + hex.EncodeToString(sum[:8])
+			}
+		}
+	}
+
+	return ``
+}
+
 func (self *OauthAuthenticator) Authenticate(w http.ResponseWriter, req *http.Request) bool {
 	if cookie, err := req.Cookie(self.cookieName); err == nil {
 		if sessionI, ok := oauthSessions.Load(cookie.Value); ok {
@@ -0,0 +1,197 @@
+package diecast
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ghetzel/go-stockutil/httputil"
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/ghetzel/go-stockutil/sliceutil"
+)
+
+var DefaultAutoindexTemplate = `/autoindex.html`
+var AutoindexOverrideFile = `/_autoindex.html`
+
+type AutoindexConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Sort       string `json:"sort"`       // one of "name", "size", or "modified"
+	Order      string `json:"order"`      // "asc" or "desc"
+	ShowHidden bool   `json:"showHidden"` // include files and directories whose names start with "."
+}
+
+// Locate the directory that the given path refers to, provided that directory listings are enabled
+// for it.  File mounts are consulted first (using the same ordering as requests for files), followed
+// by the root filesystem.
+func (self *Server) autoindexDirectory(requestPath string, req *http.Request) http.File {
+	for _, mount := range self.sortedMounts() {
+		if fileMount, ok := mount.(*FileMount); ok && fileMount.WillRespondTo(requestPath, req, nil) {
+			if fileMount.Autoindex != nil && !*fileMount.Autoindex {
+				continue
+			} else if fileMount.Autoindex == nil && !self.Autoindex.Enabled {
+				continue
+			}
+
+			dirPath := path.Join(strings.TrimSuffix(fileMount.Path, `/`), fileMount.relativePath(fileMount.MountPoint, requestPath))
+
+			var dir http.File
+			var err error
+
+			if fileMount.FileSystem == nil {
+				dir, err = os.Open(dirPath)
+			} else {
+				dir, err = fileMount.FileSystem.Open(dirPath)
+			}
+
+			if err == nil {
+				if stat, err := dir.Stat(); err == nil && stat.IsDir() {
+					return dir
+				}
+
+				dir.Close()
+			}
+		}
+	}
+
+	if self.Autoindex.Enabled {
+		if dir, err := self.fs.Open(requestPath); err == nil {
+			if stat, err := dir.Stat(); err == nil && stat.IsDir() {
+				return dir
+			}
+
+			dir.Close()
+		}
+	}
+
+	return nil
+}
+
+// Attempt to respond to the request with a listing of the requested directory.  Returns false if
+// directory listings are not enabled for the requested path, or it isn't a directory.
+func (self *Server) tryAutoindex(w http.ResponseWriter, req *http.Request, requestPath string) bool {
+	rPath := strings.TrimPrefix(requestPath, self.RoutePrefix)
+	dir := self.autoindexDirectory(rPath, req)
+
+	if dir == nil {
+		return false
+	}
+
+	defer dir.Close()
+
+	// directory listings contain relative links, so they must be viewed with a trailing slash
+	if !strings.HasSuffix(req.URL.Path, `/`) {
+		target := *req.URL
+		target.Path += `/`
+
+		http.Redirect(w, req, target.String(), http.StatusMovedPermanently)
+		return true
+	}
+
+	children, err := dir.Readdir(-1)
+
+	if err != nil {
+		self.respondError(w, err, http.StatusInternalServerError)
+		return true
+	}
+
+	entries := make([]*fileInfo, 0)
+
+	for _, child := range children {
+		if !self.Autoindex.ShowHidden && strings.HasPrefix(child.Name(), `.`) {
+			continue
+		}
+
+		entries = append(entries, &fileInfo{
+			Parent:    req.URL.Path,
+			Directory: child.IsDir(),
+			FileInfo:  child,
+		})
+	}
+
+	sortBy := sliceutil.OrString(httputil.Q(req, `sort`), self.Autoindex.Sort, `name`)
+	order := sliceutil.OrString(httputil.Q(req, `order`), self.Autoindex.Order, `asc`)
+
+	sortAutoindexEntries(entries, sortBy, order == `desc`)
+
+	var parent string
+
+	if p := strings.TrimSuffix(req.URL.Path, `/`); p != `` && p != self.RoutePrefix {
+		parent = strings.TrimSuffix(path.Dir(p), `/`) + `/`
+	}
+
+	if strings.Contains(req.Header.Get(`Accept`), `application/json`) {
+		w.Header().Set(`Content-Type`, `application/json`)
+
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			log.Warningf("autoindex: %v", err)
+		}
+
+		return true
+	}
+
+	var source io.Reader
+
+	if override, err := self.fs.Open(AutoindexOverrideFile); err == nil {
+		defer override.Close()
+		source = override
+	} else if tmpl, err := FS(false).Open(DefaultAutoindexTemplate); err == nil {
+		source = tmpl
+	} else {
+		self.respondError(w, err, http.StatusInternalServerError)
+		return true
+	}
+
+	data := requestToEvalData(req, nil)
+	data[`autoindex`] = map[string]interface{}{
+		`path`:    req.URL.Path,
+		`parent`:  parent,
+		`entries`: entries,
+		`sort`:    sortBy,
+		`order`:   order,
+	}
+
+	tmpl := NewTemplate(`autoindex`, HtmlEngine)
+	tmpl.Funcs(self.GetTemplateFunctions(data))
+
+	if err := tmpl.ParseFrom(source); err != nil {
+		self.respondError(w, fmt.Errorf("autoindex template: %v", err), http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set(`Content-Type`, `text/html; charset=utf-8`)
+
+	if err := tmpl.Render(w, data, ``); err != nil {
+		self.respondError(w, fmt.Errorf("autoindex template: %v", err), http.StatusInternalServerError)
+	}
+
+	return true
+}
+
+// Sort directory entries by the given field.  Directories are always listed before files.
+func sortAutoindexEntries(entries []*fileInfo, sortBy string, descending bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+
+		if a.IsDir() != b.IsDir() {
+			return a.IsDir()
+		}
+
+		if descending {
+			a, b = b, a
+		}
+
+		switch sortBy {
+		case `size`:
+			return a.Size() < b.Size()
+		case `modified`, `mtime`:
+			return a.ModTime().Before(b.ModTime())
+		default:
+			return strings.ToLower(a.Name()) < strings.ToLower(b.Name())
+		}
+	})
+}
@@ -14,6 +14,8 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/ghetzel/go-stockutil/httputil"
@@ -25,6 +27,23 @@ import (
 	"github.com/ghodss/yaml"
 )
 
+// Return the transport used for bindings with the given TLS verification setting.  Transports are
+// created once and reused so that connections to binding endpoints are pooled.
+func bindingTransport(insecure bool) http.RoundTripper {
+	if transport, ok := bindingTransports.Load(insecure); ok {
+		return transport.(http.RoundTripper)
+	}
+
+	transport, _ := bindingTransports.LoadOrStore(insecure, &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: insecure,
+		},
+	})
+
+	return transport.(http.RoundTripper)
+}
+
 type BindingErrorAction string
 
 const (
@@ -36,6 +55,7 @@ const (
 )
 
 var BindingClient = http.DefaultClient
+var bindingTransports sync.Map
 var AllowInsecureLoopbackBindings bool
 var DefaultParamJoiner = `;`
 
@@ -264,30 +284,29 @@ func (self *Binding) Evaluate(req *http.Request, header *TemplateHeader, data ma
 
 			bindingReq.Header.Set(`X-Diecast-Binding`, self.Name)
 
-			log.Infof("Binding: > %s %+v ? %s", strings.ToUpper(sliceutil.OrString(method, `get`)), reqUrl.String(), reqUrl.RawQuery)
-
-			// configure a transport with the requested SSL settings
-			transport := &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: self.Insecure,
-				},
+			// so that the request can be traced through the services it calls upon
+			if id := reqid(req); id != `` {
+				bindingReq.Header.Set(RequestIdHeader, id)
 			}
 
-			// setup caching transport (if desired)
-			BindingClient.Transport = transport
+			log.Infof("Binding: > %s %+v ? %s", strings.ToUpper(sliceutil.OrString(method, `get`)), reqUrl.String(), reqUrl.RawQuery)
+
+			// transports (and their connection pools) are shared by all bindings, across all sites
+			client := *BindingClient
+			client.Transport = bindingTransport(self.Insecure)
 
 			if bindingReq.URL.Scheme == `https` && self.Insecure {
 				log.Noticef("SSL/TLS certificate validation is disabled for this request.")
 				log.Noticef("This is insecure as the response can be tampered with.")
 			}
 
-			// tell the server we want to close the connection when done
-			bindingReq.Close = true
-
 			// perform binding request
 			// -------------------------------------------------------------------------------------
-			if res, err := BindingClient.Do(bindingReq); err == nil {
+			started := time.Now()
+
+			if res, err := client.Do(bindingReq); err == nil {
 				defer res.Body.Close()
+				self.server.observeBinding(self.Name, time.Since(started), res.StatusCode >= 400)
 
 				log.Infof("Binding: < HTTP %d (body: %d bytes)", res.StatusCode, res.ContentLength)
 
@@ -424,6 +443,7 @@ func (self *Binding) Evaluate(req *http.Request, header *TemplateHeader, data ma
 					return nil, fmt.Errorf("Failed to read response body: %v", err)
 				}
 			} else {
+				self.server.observeBinding(self.Name, time.Since(started), true)
 				return nil, err
 			}
 		} else {
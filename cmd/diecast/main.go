@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/ghetzel/cli"
@@ -44,6 +47,18 @@ func main() {
 			Usage: `Address the HTTP server should listen on`,
 			Value: diecast.DefaultAddress,
 		},
+		cli.StringSliceFlag{
+			Name:  `listen`,
+			Usage: `Additional addresses the HTTP server should listen on (host:port, or unix:/path/to.sock)`,
+		},
+		cli.StringFlag{
+			Name:  `socket-mode`,
+			Usage: `The file mode (in octal) of any Unix sockets the server listens on`,
+		},
+		cli.StringFlag{
+			Name:  `socket-owner`,
+			Usage: `The owner of any Unix sockets the server listens on, as "user", "user:group", or ":group"`,
+		},
 		cli.StringFlag{
 			Name:  `binding-prefix, b`,
 			Usage: `The URL to be used for templates when resolving the loopback operator (:)`,
@@ -123,6 +138,34 @@ func main() {
 			Name:  `start-command-dir`,
 			Usage: `The directory to change to when starting the start-command.`,
 		},
+		cli.StringFlag{
+			Name:  `tls-cert`,
+			Usage: `Serve HTTPS using this PEM-encoded certificate (reloaded when it changes).`,
+		},
+		cli.StringFlag{
+			Name:  `tls-key`,
+			Usage: `The PEM-encoded private key for the TLS certificate.`,
+		},
+		cli.BoolFlag{
+			Name:  `tls-self-signed`,
+			Usage: `Serve HTTPS using a generated self-signed certificate (for development).`,
+		},
+		cli.StringFlag{
+			Name:  `shutdown-timeout`,
+			Usage: `How long to wait for in-flight requests and commands to finish when shutting down.`,
+		},
+		cli.StringFlag{
+			Name:  `access-log`,
+			Usage: `Append access log entries to the given file ("-" for standard output).`,
+		},
+		cli.StringFlag{
+			Name:  `access-log-format`,
+			Usage: `The format of access log entries: "combined" (Apache combined log format) or "json".`,
+		},
+		cli.BoolFlag{
+			Name:  `watch, w`,
+			Usage: `Reload browsers when files change, and reload the configuration when it changes (for development).`,
+		},
 		cli.BoolFlag{
 			Name:  `debug, D`,
 			Usage: `Allow template debugging by appending the "?__viewsource=true" query string parameter.`,
@@ -196,12 +239,6 @@ func main() {
 			server.PrestartCommand.Directory = c.String(`prestart-command-dir`)
 		}
 
-		if cmdline := c.String(`start-command`); cmdline != `` {
-			server.StartCommand.Command = cmdline
-			server.StartCommand.Directory = c.String(`start-command-dir`)
-			server.StartCommand.WaitBefore = c.Duration(`start-command-delay`).String()
-		}
-
 		populateFlags(server.DefaultPageObject, c.StringSlice(`page`))
 		populateFlags(server.OverridePageObject, c.StringSlice(`override`))
 
@@ -209,6 +246,61 @@ func main() {
 			log.Fatalf("config error: %v", err)
 		}
 
+		if cmdline := c.String(`start-command`); cmdline != `` {
+			server.StartCommands = append(server.StartCommands, &diecast.StartCommand{
+				Command:    cmdline,
+				Directory:  c.String(`start-command-dir`),
+				WaitBefore: c.Duration(`start-command-delay`).String(),
+			})
+		}
+
+		if c.Bool(`watch`) {
+			server.Watch = true
+		}
+
+		if timeout := c.String(`shutdown-timeout`); timeout != `` {
+			server.ShutdownTimeout = timeout
+		}
+
+		if path := c.String(`access-log`); path != `` {
+			server.AccessLog.Path = path
+		}
+
+		if format := c.String(`access-log-format`); format != `` {
+			server.AccessLog.Format = format
+		}
+
+		if listeners := c.StringSlice(`listen`); len(listeners) > 0 {
+			server.Listeners = append(server.Listeners, listeners...)
+		}
+
+		if mode := c.String(`socket-mode`); mode != `` {
+			server.SocketMode = mode
+		}
+
+		if owner := c.String(`socket-owner`); owner != `` {
+			server.SocketOwner = owner
+		}
+
+		// flags only override the TLS settings they were given for; the rest come from the config file
+		if c.IsSet(`tls-cert`) || c.IsSet(`tls-key`) || c.IsSet(`tls-self-signed`) {
+			if server.TLS == nil {
+				server.TLS = new(diecast.TlsConfig)
+			}
+
+			if c.IsSet(`tls-cert`) {
+				server.TLS.Cert = c.String(`tls-cert`)
+			}
+
+			if c.IsSet(`tls-key`) {
+				server.TLS.Key = c.String(`tls-key`)
+			}
+
+			if c.IsSet(`tls-self-signed`) {
+				server.TLS.SelfSigned = c.Bool(`tls-self-signed`)
+			}
+		}
+
 		if patterns := c.StringSlice(`template-pattern`); len(patterns) > 0 {
 			if sliceutil.ContainsString(patterns, `none`) {
 				server.TemplatePatterns = nil
@@ -245,7 +337,15 @@ func main() {
 		}
 
 		if err := server.Initialize(); err == nil {
-			log.Infof("Starting HTTP server at http://%s", server.Address)
+			for _, address := range append([]string{server.Address}, server.Listeners...) {
+				if strings.HasPrefix(address, `unix:`) {
+					log.Infof("Starting HTTP server at %s", address)
+				} else if server.TLS.Enabled() {
+					log.Infof("Starting HTTPS server at https://%s", address)
+				} else {
+					log.Infof("Starting HTTP server at http://%s", address)
+				}
+			}
 
 			go func() {
 				if err := server.Serve(); err != nil {
@@ -315,6 +415,13 @@ func main() {
 							}
 
 							file.Close()
+
+							// write compressed copies for servers that can serve them directly
+							if server.Compression.Precompress {
+								if err := server.Compression.PrecompressFile(destFile, response.Header.Get(`Content-Type`)); err != nil {
+									log.Fatalf("Failed to compress file %v: %v", destFile, err)
+								}
+							}
 						} else {
 							log.Fatalf("Failed to create file %v: %v", destFile, err)
 						}
@@ -323,7 +430,16 @@ func main() {
 					}
 				}
 			} else {
-				select {}
+				// wait for a signal to stop, then give in-flight requests and commands time to finish
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+				sig := <-signals
+				log.Infof("Received %v, shutting down", sig)
+
+				if err := server.Shutdown(context.Background()); err != nil {
+					log.Warningf("Shutdown did not complete cleanly: %v", err)
+				}
 			}
 		} else {
 			log.Fatalf("Failed to start HTTP server: %v", err)
@@ -0,0 +1,624 @@
+package diecast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/ghetzel/go-stockutil/pathutil"
+	"github.com/ghetzel/go-stockutil/stringutil"
+	"github.com/ghetzel/go-stockutil/timeutil"
+	shellwords "github.com/mattn/go-shellwords"
+)
+
+var DefaultRestartDelay = time.Second
+var DefaultMaxRestartDelay = time.Minute
+var DefaultReadyTimeout = 30 * time.Second
+var DefaultReadyInterval = 250 * time.Millisecond
+
+type RestartPolicy string
+
+const (
+	RestartNever     RestartPolicy = `never`
+	RestartOnFailure RestartPolicy = `on-failure`
+	RestartAlways    RestartPolicy = `always`
+)
+
+// A ReadinessCheck determines when a command is ready to accept requests: either once a GET request to
+// the given URL succeeds, or once a TCP connection can be made to the given address.
+type ReadinessCheck struct {
+	URL      string `json:"url"`
+	Address  string `json:"tcp"`
+	Interval string `json:"interval"` // how often to check (default: 250ms)
+	Timeout  string `json:"timeout"`  // how long to wait for the command to become ready (default: 30s)
+}
+
+func (self *ReadinessCheck) check() error {
+	if self.URL != `` {
+		client := &http.Client{
+			Timeout: time.Second,
+		}
+
+		if res, err := client.Get(self.URL); err == nil {
+			res.Body.Close()
+
+			if res.StatusCode >= 400 {
+				return fmt.Errorf("HTTP %v", res.Status)
+			}
+		} else {
+			return err
+		}
+	}
+
+	if self.Address != `` {
+		if conn, err := net.DialTimeout(`tcp`, self.Address, time.Second); err == nil {
+			conn.Close()
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type CommandStatus struct {
+	Name      string    `json:"name"`
+	Command   string    `json:"command"`
+	State     string    `json:"state"` // one of "starting", "running", "exited", "failed", "backoff", or "stopped"
+	Ready     bool      `json:"ready"`
+	PID       int       `json:"pid,omitempty"`
+	Restarts  int       `json:"restarts"`
+	ExitCode  int       `json:"exit_code"`
+	LastError string    `json:"last_error,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+}
+
+type StartCommand struct {
+	Name             string                 `json:"name"` // used to prefix the command's output in the log (default: the program name)
+	Command          string                 `json:"command"`
+	Directory        string                 `json:"directory"`
+	Environment      map[string]interface{} `json:"env"`
+	WaitBefore       string                 `json:"delay"`
+	Wait             string                 `json:"timeout"`
+	ExitOnCompletion bool                   `json:"exitOnCompletion"`
+	Restart          RestartPolicy          `json:"restart"`         // one of "never" (default), "on-failure", or "always"
+	RestartDelay     string                 `json:"restartDelay"`    // how long to wait before the first restart; doubles with each consecutive restart
+	MaxRestartDelay  string                 `json:"maxRestartDelay"` // the longest to wait between restarts
+	Ready            *ReadinessCheck        `json:"ready"`           // wait for this check to pass before the server starts serving
+	cmd              *exec.Cmd
+	running          bool
+	exited           chan struct{}
+	status           CommandStatus
+	stopping         bool
+	stopped          chan struct{}
+	ready            chan struct{}
+	lock             sync.Mutex
+	initOnce         sync.Once
+}
+
+func (self *StartCommand) String() string {
+	if self.Name != `` {
+		return self.Name
+	} else if tokens, err := shellwords.Parse(self.Command); err == nil && len(tokens) > 0 {
+		return filepath.Base(tokens[0])
+	} else {
+		return `command`
+	}
+}
+
+func (self *StartCommand) init() {
+	self.initOnce.Do(func() {
+		self.stopped = make(chan struct{})
+		self.ready = make(chan struct{})
+		self.status.Name = self.String()
+		self.status.Command = self.Command
+		self.status.State = `starting`
+	})
+}
+
+// Returns the current state of the command.
+func (self *StartCommand) Status() CommandStatus {
+	self.init()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.status
+}
+
+// Returns the process ID of the running command (if any).
+func (self *StartCommand) Pid() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.running {
+		return self.cmd.Process.Pid
+	}
+
+	return 0
+}
+
+func (self *StartCommand) durationOr(value string, fallback time.Duration) time.Duration {
+	if d, err := timeutil.ParseDuration(value); err == nil && d > 0 {
+		return d
+	}
+
+	return fallback
+}
+
+func (self *StartCommand) isStopping() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.stopping
+}
+
+// Stop supervising the command and terminate it (along with any processes it started).
+func (self *StartCommand) stop(grace time.Duration) {
+	self.init()
+	self.lock.Lock()
+
+	if !self.stopping {
+		self.stopping = true
+		close(self.stopped)
+	}
+
+	var pid int
+	var exited chan struct{}
+
+	if self.running {
+		pid = self.cmd.Process.Pid
+		exited = self.exited
+	} else {
+		self.status.State = `stopped`
+	}
+
+	self.lock.Unlock()
+
+	if pid > 0 {
+		terminateProcessGroup(pid, grace)
+
+		// wait for the process to be reaped, so that its status is up to date when we return
+		select {
+		case <-exited:
+		case <-time.After(grace):
+		}
+	}
+}
+
+// Start commands may be given as a single command or as a list.
+type StartCommands []*StartCommand
+
+func (self *StartCommands) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte(`{`)) {
+		var scmd StartCommand
+
+		if err := json.Unmarshal(data, &scmd); err == nil {
+			*self = StartCommands{&scmd}
+			return nil
+		} else {
+			return err
+		}
+	}
+
+	var scmds []*StartCommand
+
+	if err := json.Unmarshal(data, &scmds); err == nil {
+		*self = StartCommands(scmds)
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (self *Server) commandFor(scmd *StartCommand) (*exec.Cmd, error) {
+	tokens, err := shellwords.Parse(scmd.Command)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid command: %v", err)
+	} else if len(tokens) == 0 {
+		return nil, fmt.Errorf("invalid command: empty")
+	}
+
+	cmd := exec.Command(tokens[0], tokens[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	// don't let processes that inherited our stdout/stderr hold up a command that has exited
+	cmd.WaitDelay = time.Second
+
+	env := make(map[string]interface{})
+
+	for _, pair := range os.Environ() {
+		key, value := stringutil.SplitPair(pair, `=`)
+		env[key] = value
+	}
+
+	for key, value := range scmd.Environment {
+		env[key] = value
+	}
+
+	env[`DIECAST`] = true
+	env[`DIECAST_BIN`] = self.BinPath
+	env[`DIECAST_DEBUG`] = self.EnableDebugging
+	env[`DIECAST_ADDRESS`] = self.Address
+	env[`DIECAST_ROOT`] = self.RootPath
+	env[`DIECAST_PATH_LAYOUTS`] = self.LayoutPath
+	env[`DIECAST_PATH_ERRORS`] = self.ErrorsPath
+	env[`DIECAST_BINDING_PREFIX`] = self.BindingPrefix
+	env[`DIECAST_ROUTE_PREFIX`] = self.RoutePrefix
+
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%v=%v", key, value))
+	}
+
+	if dir := scmd.Directory; dir != `` {
+		if xdir, err := pathutil.ExpandUser(dir); err == nil {
+			if absdir, err := filepath.Abs(xdir); err == nil {
+				cmd.Dir = absdir
+			} else {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	cmd.Stdout = &commandLogWriter{
+		prefix: scmd.String(),
+	}
+
+	cmd.Stderr = &commandLogWriter{
+		prefix: scmd.String(),
+		stderr: true,
+	}
+
+	return cmd, nil
+}
+
+// Run the given command, restarting it according to its restart policy.  If waitForCommand is true,
+// this blocks until the command exits for the last time.
+func (self *Server) RunStartCommand(scmd *StartCommand, waitForCommand bool) error {
+	if scmd.Command == `` {
+		return nil
+	}
+
+	scmd.init()
+
+	if _, err := shellwords.Parse(scmd.Command); err != nil {
+		return fmt.Errorf("invalid command: %v", err)
+	}
+
+	if prewait, err := timeutil.ParseDuration(scmd.WaitBefore); err == nil && prewait > 0 {
+		log.Infof("Waiting %v before running command", prewait)
+		time.Sleep(prewait)
+	}
+
+	wait, err := timeutil.ParseDuration(scmd.Wait)
+
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- self.superviseCommand(scmd)
+	}()
+
+	time.Sleep(wait)
+
+	if waitForCommand {
+		return <-done
+	} else {
+		return nil
+	}
+}
+
+func (self *Server) superviseCommand(scmd *StartCommand) error {
+	delay := scmd.durationOr(scmd.RestartDelay, DefaultRestartDelay)
+	maxDelay := scmd.durationOr(scmd.MaxRestartDelay, DefaultMaxRestartDelay)
+
+	for {
+		started := time.Now()
+		err := self.runCommandOnce(scmd)
+
+		if scmd.isStopping() {
+			scmd.lock.Lock()
+			scmd.status.State = `stopped`
+			scmd.lock.Unlock()
+
+			return nil
+		}
+
+		switch scmd.Restart {
+		case RestartAlways:
+		case RestartOnFailure:
+			if err == nil {
+				return nil
+			}
+		default:
+			return err
+		}
+
+		// a command that stayed up for a while is considered healthy again
+		if time.Since(started) > maxDelay {
+			delay = scmd.durationOr(scmd.RestartDelay, DefaultRestartDelay)
+		}
+
+		scmd.lock.Lock()
+		scmd.status.State = `backoff`
+		scmd.lock.Unlock()
+
+		log.Warningf("[%v] exited (%v), restarting in %v", scmd, exitDescription(err), delay)
+
+		select {
+		case <-scmd.stopped:
+			return nil
+		case <-time.After(delay):
+		}
+
+		scmd.lock.Lock()
+		scmd.status.Restarts++
+		scmd.lock.Unlock()
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+func exitDescription(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	return `exit status 0`
+}
+
+// Run the command until it exits, checking its readiness (if configured) while it runs.
+func (self *Server) runCommandOnce(scmd *StartCommand) error {
+	cmd, err := self.commandFor(scmd)
+
+	if err != nil {
+		scmd.lock.Lock()
+		scmd.status.State = `failed`
+		scmd.status.LastError = err.Error()
+		scmd.lock.Unlock()
+
+		return err
+	}
+
+	scmd.lock.Lock()
+
+	if scmd.stopping {
+		scmd.lock.Unlock()
+		return nil
+	}
+
+	log.Infof("Executing command: %v", strings.Join(cmd.Args, ` `))
+
+	if err := cmd.Start(); err != nil {
+		scmd.status.State = `failed`
+		scmd.status.LastError = err.Error()
+		scmd.lock.Unlock()
+
+		return err
+	}
+
+	exited := make(chan struct{})
+
+	scmd.cmd = cmd
+	scmd.running = true
+	scmd.exited = exited
+	scmd.status.State = `running`
+	scmd.status.PID = cmd.Process.Pid
+	scmd.status.StartedAt = time.Now()
+	scmd.status.Ready = false
+	scmd.lock.Unlock()
+
+	defer close(exited)
+
+	if scmd.Ready != nil {
+		go self.checkReadiness(scmd, exited)
+	} else {
+		scmd.markReady()
+	}
+
+	err = cmd.Wait()
+
+	scmd.lock.Lock()
+	defer scmd.lock.Unlock()
+
+	scmd.running = false
+	scmd.status.PID = 0
+	scmd.status.Ready = false
+	scmd.status.ExitCode = cmd.ProcessState.ExitCode()
+
+	if scmd.stopping {
+		scmd.status.State = `stopped`
+	} else if err == nil {
+		scmd.status.State = `exited`
+		scmd.status.LastError = ``
+	} else {
+		scmd.status.State = `failed`
+		scmd.status.LastError = err.Error()
+	}
+
+	return err
+}
+
+func (self *StartCommand) markReady() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.status.Ready = true
+
+	select {
+	case <-self.ready:
+	default:
+		close(self.ready)
+	}
+}
+
+func (self *Server) checkReadiness(scmd *StartCommand, exited chan struct{}) {
+	interval := scmd.durationOr(scmd.Ready.Interval, DefaultReadyInterval)
+
+	for {
+		if err := scmd.Ready.check(); err == nil {
+			log.Infof("[%v] ready", scmd)
+			scmd.markReady()
+			return
+		}
+
+		select {
+		case <-exited:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Run the start commands for this server (and its sites) in the background.  When a command with
+// exitOnCompletion finishes, all commands are stopped and the process exits.
+func (self *Server) runStartCommands(root *Server) {
+	for _, scmd := range self.StartCommands {
+		if scmd == nil {
+			continue
+		}
+
+		go func(scmd *StartCommand) {
+			err := self.RunStartCommand(scmd, true)
+
+			if err != nil {
+				log.Errorf("start command %v failed: %v", scmd, err)
+			}
+
+			if scmd.ExitOnCompletion && !scmd.isStopping() {
+				root.cleanupCommands()
+
+				if err != nil {
+					os.Exit(1)
+				} else {
+					os.Exit(0)
+				}
+			}
+		}(scmd)
+	}
+
+	for _, site := range self.Sites {
+		if site.server != nil {
+			site.server.runStartCommands(root)
+		}
+	}
+}
+
+// Wait for every command (including those belonging to sites) with a readiness check to pass it.
+func (self *Server) waitForCommands() error {
+	for _, scmd := range self.commands() {
+		if scmd.Ready == nil {
+			continue
+		}
+
+		scmd.init()
+		timeout := scmd.durationOr(scmd.Ready.Timeout, DefaultReadyTimeout)
+
+		log.Infof("Waiting up to %v for %v to become ready", timeout, scmd)
+
+		select {
+		case <-scmd.ready:
+		case <-time.After(timeout):
+			return fmt.Errorf("command %v did not become ready within %v", scmd, timeout)
+		}
+	}
+
+	for _, site := range self.Sites {
+		if site.server != nil {
+			if err := site.server.waitForCommands(); err != nil {
+				return fmt.Errorf("%v: %v", site, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Return the prestart and start commands for this server.
+func (self *Server) commands() []*StartCommand {
+	// the commands keep running under the server the configuration was reloaded from
+	if self.host != nil {
+		return self.host.commands()
+	}
+
+	commands := make([]*StartCommand, 0)
+
+	if self.PrestartCommand.Command != `` {
+		commands = append(commands, &self.PrestartCommand)
+	}
+
+	for _, scmd := range self.StartCommands {
+		if scmd != nil && scmd.Command != `` {
+			commands = append(commands, scmd)
+		}
+	}
+
+	return commands
+}
+
+func (self *Server) cleanupCommands() {
+	grace := self.shutdownTimeout()
+
+	for _, scmd := range self.commands() {
+		scmd.stop(grace)
+	}
+
+	for _, site := range self.Sites {
+		if site.server != nil {
+			site.server.cleanupCommands()
+		}
+	}
+}
+
+// Writes each line of a command's output to the log, prefixed with the command's name.
+type commandLogWriter struct {
+	prefix string
+	stderr bool
+	buffer bytes.Buffer
+}
+
+func (self *commandLogWriter) Write(p []byte) (int, error) {
+	self.buffer.Write(p)
+
+	for {
+		line, err := self.buffer.ReadString('\n')
+
+		if err != nil {
+			// incomplete line; wait for the rest of it
+			self.buffer.Reset()
+			self.buffer.WriteString(line)
+			break
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if self.stderr {
+			log.Warningf("[%v] %v", self.prefix, line)
+		} else {
+			log.Infof("[%v] %v", self.prefix, line)
+		}
+	}
+
+	return len(p), nil
+}
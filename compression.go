@@ -0,0 +1,403 @@
+package diecast
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ghetzel/go-stockutil/stringutil"
+)
+
+// Supported content encodings, in the order they are preferred (if the client accepts more than one).
+var DefaultCompressionEncodings = []string{`br`, `gzip`}
+
+// Responses smaller than this (in bytes) are not worth compressing.
+var DefaultCompressionMinSize = 1024
+
+// Media types that are compressed by default.  Entries may contain wildcards (e.g.: "text/*").
+var DefaultCompressibleTypes = []string{
+	`text/*`,
+	`application/javascript`,
+	`application/json`,
+	`application/*+json`,
+	`application/xml`,
+	`application/*+xml`,
+	`application/wasm`,
+	`image/svg+xml`,
+}
+
+// File extensions used for pre-compressed copies of files, by content encoding.
+var PrecompressedExtensions = map[string]string{
+	`br`:   `.br`,
+	`gzip`: `.gz`,
+}
+
+type CompressionConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Encodings    []string `json:"encodings"`    // content encodings to use ("br", "gzip"), in order of preference
+	MinSize      int      `json:"minSize"`      // responses smaller than this (in bytes) are sent uncompressed
+	ContentTypes []string `json:"contentTypes"` // media types to compress (wildcards permitted)
+	Precompress  bool     `json:"precompress"`  // write compressed copies of files alongside them when building a static site
+}
+
+func (self *CompressionConfig) encodings() []string {
+	if len(self.Encodings) > 0 {
+		return self.Encodings
+	}
+
+	return DefaultCompressionEncodings
+}
+
+func (self *CompressionConfig) minSize() int {
+	if self.MinSize > 0 {
+		return self.MinSize
+	}
+
+	return DefaultCompressionMinSize
+}
+
+// Returns whether responses of the given content type should be compressed.
+func (self *CompressionConfig) Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return false
+	}
+
+	patterns := self.ContentTypes
+
+	if len(patterns) == 0 {
+		patterns = DefaultCompressibleTypes
+	}
+
+	for _, pattern := range patterns {
+		if match, err := path.Match(strings.ToLower(pattern), mediaType); err == nil && match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Choose the content encoding to use for the given Accept-Encoding request header, or an empty string
+// if none of the configured encodings are acceptable.
+func (self *CompressionConfig) negotiate(acceptEncoding string) string {
+	accepted := make(map[string]float64)
+
+	for _, part := range strings.Split(acceptEncoding, `,`) {
+		name, params := stringutil.SplitPair(strings.TrimSpace(part), `;`)
+		quality := 1.0
+
+		if q := strings.TrimSpace(params); strings.HasPrefix(q, `q=`) {
+			if v, err := strconv.ParseFloat(strings.TrimPrefix(q, `q=`), 64); err == nil {
+				quality = v
+			}
+		}
+
+		if name != `` {
+			accepted[strings.ToLower(name)] = quality
+		}
+	}
+
+	for _, encoding := range self.encodings() {
+		if quality, ok := accepted[encoding]; ok {
+			if quality > 0 {
+				return encoding
+			}
+		} else if quality, ok := accepted[`*`]; ok && quality > 0 {
+			return encoding
+		}
+	}
+
+	return ``
+}
+
+var compressorPools = map[string]*sync.Pool{
+	`gzip`: {
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	},
+	`br`: {
+		New: func() interface{} {
+			return brotli.NewWriter(nil)
+		},
+	},
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Return a compressor for the given encoding that writes to w.  It should be returned to its pool
+// with releaseCompressor once it has been closed.
+func getCompressor(encoding string, w io.Writer) (compressor, error) {
+	if pool, ok := compressorPools[encoding]; ok {
+		c := pool.Get().(compressor)
+		c.Reset(w)
+		return c, nil
+	}
+
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+func releaseCompressor(encoding string, c compressor) {
+	if pool, ok := compressorPools[encoding]; ok {
+		c.Reset(nil)
+		pool.Put(c)
+	}
+}
+
+// Write compressed copies of the given file (of the given content type) alongside it, one for each
+// configured encoding (e.g.: "index.html.gz" and "index.html.br").  Files that are too small or not of
+// a compressible type are skipped.
+func (self *CompressionConfig) PrecompressFile(filename string, contentType string) error {
+	if !self.Compressible(contentType) {
+		return nil
+	}
+
+	if stat, err := os.Stat(filename); err != nil {
+		return err
+	} else if stat.Size() < int64(self.minSize()) {
+		return nil
+	}
+
+	for _, encoding := range self.encodings() {
+		if err := precompressFile(filename, encoding); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func precompressFile(filename string, encoding string) error {
+	ext, ok := PrecompressedExtensions[encoding]
+
+	if !ok {
+		return fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	src, err := os.Open(filename)
+
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dest, err := os.Create(filename + ext)
+
+	if err != nil {
+		return err
+	}
+
+	defer dest.Close()
+
+	c, err := getCompressor(encoding, dest)
+
+	if err != nil {
+		return err
+	}
+
+	defer releaseCompressor(encoding, c)
+
+	if _, err := io.Copy(c, src); err != nil {
+		return err
+	}
+
+	if err := c.Close(); err != nil {
+		return err
+	}
+
+	return dest.Close()
+}
+
+// Middleware that compresses responses using an encoding the client accepts.
+func (self *Server) compressResponses(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	encoding := self.Compression.negotiate(req.Header.Get(`Accept-Encoding`))
+
+	if encoding == `` || req.Method == http.MethodHead || req.Header.Get(`Upgrade`) != `` {
+		next(w, req)
+		return
+	}
+
+	writer := &compressWriter{
+		ResponseWriter: w,
+		config:         &self.Compression,
+		encoding:       encoding,
+	}
+
+	next(writer, req)
+	writer.finish()
+}
+
+// Compresses eligible responses once they're large enough to be worth it.  Responses that are already
+// encoded, not of a compressible type, partial, or have no body are passed through untouched.
+type compressWriter struct {
+	http.ResponseWriter
+	config      *CompressionConfig
+	encoding    string
+	status      int
+	wroteHeader bool
+	buffering   bool
+	buffer      []byte
+	compressor  compressor
+}
+
+func (self *compressWriter) WriteHeader(status int) {
+	if self.wroteHeader {
+		return
+	}
+
+	self.wroteHeader = true
+	self.status = status
+
+	if self.config.Compressible(self.Header().Get(`Content-Type`)) {
+		if !varies(self.Header(), `Accept-Encoding`) {
+			self.Header().Add(`Vary`, `Accept-Encoding`)
+		}
+
+		// hold on to the response until we know whether it's big enough to compress
+		if self.eligible(status) {
+			self.buffering = true
+			return
+		}
+	}
+
+	self.ResponseWriter.WriteHeader(status)
+}
+
+// Returns whether the given headers already include the named header in Vary.
+func varies(header http.Header, name string) bool {
+	for _, value := range header.Values(`Vary`) {
+		for _, field := range strings.Split(value, `,`) {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns whether a response with the given status (and the headers set so far) may be compressed.
+func (self *compressWriter) eligible(status int) bool {
+	header := self.Header()
+
+	switch {
+	case status < 200, status == http.StatusNoContent, status == http.StatusNotModified, status == http.StatusPartialContent:
+		return false
+	case header.Get(`Content-Encoding`) != `` && header.Get(`Content-Encoding`) != `identity`:
+		// already encoded (e.g.: by an upstream server)
+		return false
+	case header.Get(`Content-Range`) != ``, strings.Contains(header.Get(`Cache-Control`), `no-transform`):
+		return false
+	}
+
+	if length, err := strconv.Atoi(header.Get(`Content-Length`)); err == nil && length < self.config.minSize() {
+		return false
+	}
+
+	return true
+}
+
+func (self *compressWriter) Write(p []byte) (int, error) {
+	if !self.wroteHeader {
+		if self.Header().Get(`Content-Type`) == `` {
+			self.Header().Set(`Content-Type`, http.DetectContentType(p))
+		}
+
+		self.WriteHeader(http.StatusOK)
+	}
+
+	if self.compressor != nil {
+		return self.compressor.Write(p)
+	} else if !self.buffering {
+		return self.ResponseWriter.Write(p)
+	}
+
+	self.buffer = append(self.buffer, p...)
+
+	if len(self.buffer) >= self.config.minSize() {
+		if err := self.startCompressing(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (self *compressWriter) startCompressing() error {
+	header := self.Header()
+	header.Set(`Content-Encoding`, self.encoding)
+	header.Del(`Content-Length`)
+
+	// the compressed representation is not byte-for-byte identical to the original
+	if etag := header.Get(`ETag`); etag != `` && !strings.HasPrefix(etag, `W/`) {
+		header.Set(`ETag`, `W/`+etag)
+	}
+
+	self.buffering = false
+	self.ResponseWriter.WriteHeader(self.status)
+
+	if c, err := getCompressor(self.encoding, self.ResponseWriter); err == nil {
+		self.compressor = c
+	} else {
+		return err
+	}
+
+	buffer := self.buffer
+	self.buffer = nil
+
+	_, err := self.compressor.Write(buffer)
+	return err
+}
+
+// Streaming responses are compressed as they are flushed, regardless of size.
+func (self *compressWriter) Flush() {
+	if self.buffering && len(self.buffer) > 0 {
+		self.startCompressing()
+	}
+
+	if self.compressor != nil {
+		self.compressor.Flush()
+	}
+
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok && !self.buffering {
+		flusher.Flush()
+	}
+}
+
+func (self *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := self.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+
+	return nil, nil, fmt.Errorf("%T does not support hijacking", self.ResponseWriter)
+}
+
+func (self *compressWriter) finish() {
+	if self.compressor != nil {
+		self.compressor.Close()
+		releaseCompressor(self.encoding, self.compressor)
+		self.compressor = nil
+	} else if self.buffering {
+		// too small to bother compressing
+		self.Header().Set(`Content-Length`, strconv.Itoa(len(self.buffer)))
+		self.ResponseWriter.WriteHeader(self.status)
+		self.ResponseWriter.Write(self.buffer)
+	}
+}
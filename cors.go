@@ -0,0 +1,225 @@
+package diecast
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/go-stockutil/sliceutil"
+	"github.com/ghetzel/go-stockutil/timeutil"
+	"github.com/gobwas/glob"
+)
+
+// Methods that cross-origin requests may use if a policy doesn't specify any.
+var DefaultCorsMethods = []string{`GET`, `HEAD`, `POST`}
+
+// Controls which other origins may make requests to matching paths (Cross-Origin Resource Sharing).
+type CorsPolicy struct {
+	Paths         []string `json:"paths"`       // paths (which may contain wildcards) the policy applies to (default: all paths)
+	Origins       []string `json:"origins"`     // origins that are permitted (e.g.: "https://*.example.com"), or "*" for any
+	Methods       []string `json:"methods"`     // methods that are permitted (default: GET, HEAD, and POST)
+	Headers       []string `json:"headers"`     // request headers that are permitted, or "*" for any
+	ExposeHeaders []string `json:"expose"`      // response headers that scripts may read
+	Credentials   bool     `json:"credentials"` // whether requests may include cookies and authorization
+	MaxAge        string   `json:"maxAge"`      // how long browsers may cache the response to a preflight request (e.g.: "10m")
+	globs         []glob.Glob
+	origins       []glob.Glob
+}
+
+func (self *CorsPolicy) init() error {
+	self.globs = nil
+	self.origins = nil
+
+	// otherwise any website could read the responses to requests made with a visitor's credentials
+	if self.Credentials && sliceutil.ContainsString(self.Origins, `*`) {
+		return fmt.Errorf("credentials cannot be permitted for any origin (\"*\"); list the permitted origins instead")
+	}
+
+	for _, pattern := range self.Paths {
+		if g, err := glob.Compile(pattern); err == nil {
+			self.globs = append(self.globs, g)
+		} else {
+			return fmt.Errorf("invalid path %q: %v", pattern, err)
+		}
+	}
+
+	// wildcards match a single part of a hostname ("**" matches any number of them)
+	for _, pattern := range self.Origins {
+		if g, err := glob.Compile(strings.ToLower(pattern), '.'); err == nil {
+			self.origins = append(self.origins, g)
+		} else {
+			return fmt.Errorf("invalid origin %q: %v", pattern, err)
+		}
+	}
+
+	if self.MaxAge != `` {
+		if _, err := timeutil.ParseDuration(self.MaxAge); err != nil {
+			return fmt.Errorf("invalid maxAge %q: %v", self.MaxAge, err)
+		}
+	}
+
+	return nil
+}
+
+func (self *CorsPolicy) appliesTo(requestPath string) bool {
+	if len(self.globs) == 0 {
+		return true
+	}
+
+	for _, g := range self.globs {
+		if g.Match(requestPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self *CorsPolicy) allowsOrigin(origin string) bool {
+	if sliceutil.ContainsString(self.Origins, `*`) {
+		return true
+	}
+
+	for _, g := range self.origins {
+		if g.Match(strings.ToLower(origin)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self *CorsPolicy) methods() []string {
+	if len(self.Methods) > 0 {
+		return self.Methods
+	}
+
+	return DefaultCorsMethods
+}
+
+func (self *CorsPolicy) allowsMethod(method string) bool {
+	for _, allowed := range self.methods() {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self *CorsPolicy) allowsHeader(name string) bool {
+	for _, allowed := range self.Headers {
+		if allowed == `*` || strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Set the headers that tell the browser the given origin may read the response.
+func (self *CorsPolicy) allowOrigin(header http.Header, origin string) {
+	// credentials are never permitted for any origin (see init), and browsers require requests with
+	// credentials to be answered with the origin itself rather than "*"
+	if sliceutil.ContainsString(self.Origins, `*`) {
+		header.Set(`Access-Control-Allow-Origin`, `*`)
+	} else {
+		header.Set(`Access-Control-Allow-Origin`, origin)
+
+		if self.Credentials {
+			header.Set(`Access-Control-Allow-Credentials`, `true`)
+		}
+	}
+}
+
+func (self *Server) setupCors() error {
+	for i := range self.Cors {
+		if err := self.Cors[i].init(); err != nil {
+			return fmt.Errorf("cors policy %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Return the first CORS policy that applies to the given path.
+func (self *Server) corsPolicyFor(requestPath string) *CorsPolicy {
+	for i := range self.Cors {
+		if policy := &self.Cors[i]; policy.appliesTo(requestPath) {
+			return policy
+		}
+	}
+
+	return nil
+}
+
+// Middleware that answers CORS preflight requests, and adds CORS headers to the responses of
+// cross-origin requests from permitted origins.
+func (self *Server) applyCors(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	policy := self.corsPolicyFor(req.URL.Path)
+
+	if policy == nil {
+		next(w, req)
+		return
+	}
+
+	header := w.Header()
+
+	if !varies(header, `Origin`) {
+		header.Add(`Vary`, `Origin`)
+	}
+
+	origin := req.Header.Get(`Origin`)
+	requestMethod := req.Header.Get(`Access-Control-Request-Method`)
+
+	// not a preflight request: let the browser read the response if the origin is allowed
+	if req.Method != http.MethodOptions || requestMethod == `` {
+		if origin != `` && policy.allowsOrigin(origin) {
+			policy.allowOrigin(header, origin)
+
+			if len(policy.ExposeHeaders) > 0 {
+				header.Set(`Access-Control-Expose-Headers`, strings.Join(policy.ExposeHeaders, `, `))
+			}
+		}
+
+		next(w, req)
+		return
+	}
+
+	header.Add(`Vary`, `Access-Control-Request-Method`)
+	header.Add(`Vary`, `Access-Control-Request-Headers`)
+
+	if origin == `` || !policy.allowsOrigin(origin) || !policy.allowsMethod(requestMethod) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	requestHeaders := make([]string, 0)
+
+	for _, value := range req.Header.Values(`Access-Control-Request-Headers`) {
+		for _, name := range strings.Split(value, `,`) {
+			if name = strings.TrimSpace(name); name == `` {
+				continue
+			} else if !policy.allowsHeader(name) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			requestHeaders = append(requestHeaders, name)
+		}
+	}
+
+	policy.allowOrigin(header, origin)
+	header.Set(`Access-Control-Allow-Methods`, strings.ToUpper(strings.Join(policy.methods(), `, `)))
+
+	if len(requestHeaders) > 0 {
+		header.Set(`Access-Control-Allow-Headers`, strings.Join(requestHeaders, `, `))
+	}
+
+	if maxAge, err := timeutil.ParseDuration(policy.MaxAge); err == nil && maxAge > 0 {
+		header.Set(`Access-Control-Max-Age`, strconv.Itoa(int(maxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,426 @@
+package diecast
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/ghetzel/go-stockutil/pathutil"
+	"github.com/ghetzel/go-stockutil/stringutil"
+	"github.com/ghetzel/go-stockutil/timeutil"
+	"github.com/mattn/go-shellwords"
+)
+
+var DefaultExecMountTimeout = time.Duration(30) * time.Second
+var DefaultExecMaxOutputSize int64 = 33554432 // 32 MiB
+
+type ExecInputFormat string
+
+const (
+	ExecInputCGI  ExecInputFormat = `cgi`
+	ExecInputJSON ExecInputFormat = `json`
+)
+
+// An ExecMount runs a command for every request it responds to.  Details about the request are
+// passed to the command as CGI-style environment variables (with the request body on standard input),
+// or as a JSON document on standard input (with the request body base64-encoded).  The command's
+// standard output is parsed as a CGI response: an optional block of headers (including a "Status"
+// header), a blank line, then the response body.
+type ExecMount struct {
+	MountPoint    string                 `json:"-"`
+	Command       string                 `json:"command"`
+	Directory     string                 `json:"directory"`
+	Environment   map[string]interface{} `json:"env"`
+	Timeout       string                 `json:"timeout"`
+	Concurrency   int                    `json:"concurrency"`
+	Input         string                 `json:"input"`
+	MaxOutputSize int64                  `json:"max_output_size"`
+	slots         chan bool
+	slotsInit     sync.Once
+	MountMatcher
+}
+
+type execRequest struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   map[string][]string `json:"query"`
+	Headers map[string][]string `json:"headers"`
+	Body    []byte              `json:"body"` // base64-encoded
+	Remote  string              `json:"remote_address"`
+	Host    string              `json:"host"`
+}
+
+func (self *ExecMount) GetMountPoint() string {
+	return self.MountPoint
+}
+
+func (self *ExecMount) WillRespondTo(name string, req *http.Request, requestBody io.Reader) bool {
+	return self.matches(self.GetMountPoint(), name, req)
+}
+
+func (self *ExecMount) OpenWithType(name string, req *http.Request, requestBody io.Reader) (*MountResponse, error) {
+	tokens, err := shellwords.Parse(self.Command)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid command: %v", err)
+	} else if len(tokens) == 0 {
+		return nil, fmt.Errorf("%v: no command specified", self)
+	}
+
+	timeout := DefaultExecMountTimeout
+
+	if d, err := timeutil.ParseDuration(self.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// wait for a free slot if we're limiting how many commands can run at once
+	if release, err := self.acquire(ctx); err == nil {
+		defer release()
+	} else {
+		log.Warningf("%v: %v", self, err)
+		return self.errorResponse(name, http.StatusServiceUnavailable), nil
+	}
+
+	if req == nil {
+		req, _ = http.NewRequest(`GET`, name, nil)
+	}
+
+	var body []byte
+
+	if requestBody != nil {
+		if data, err := ioutil.ReadAll(requestBody); err == nil {
+			body = data
+		} else {
+			return nil, err
+		}
+	}
+
+	cmd := exec.Command(tokens[0], tokens[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	if dir := self.Directory; dir != `` {
+		if xdir, err := pathutil.ExpandUser(dir); err == nil {
+			if absdir, err := filepath.Abs(xdir); err == nil {
+				cmd.Dir = absdir
+			} else {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	env := make(map[string]interface{})
+
+	for _, pair := range os.Environ() {
+		key, value := stringutil.SplitPair(pair, `=`)
+		env[key] = value
+	}
+
+	for key, value := range self.Environment {
+		env[key] = value
+	}
+
+	env[`DIECAST`] = true
+
+	switch ExecInputFormat(strings.ToLower(self.Input)) {
+	case ExecInputJSON:
+		if data, err := json.Marshal(&execRequest{
+			Method:  req.Method,
+			Path:    strings.TrimPrefix(name, strings.TrimSuffix(self.MountPoint, `/`)),
+			Query:   req.URL.Query(),
+			Headers: req.Header,
+			Body:    body,
+			Remote:  req.RemoteAddr,
+			Host:    req.Host,
+		}); err == nil {
+			cmd.Stdin = bytes.NewReader(data)
+		} else {
+			return nil, err
+		}
+
+	case ExecInputCGI, ``:
+		for key, value := range cgiEnvironment(self.MountPoint, name, req, len(body)) {
+			env[key] = value
+		}
+
+		cmd.Stdin = bytes.NewReader(body)
+
+	default:
+		return nil, fmt.Errorf("%v: unknown input format %q", self, self.Input)
+	}
+
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%v=%v", key, value))
+	}
+
+	var stderr bytes.Buffer
+
+	stdout := &cappedBuffer{
+		Max: self.maxOutputSize(),
+		// stop the command as soon as it has produced too much output
+		OnExceeded: func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		},
+	}
+
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	log.Debugf("  exec: %v", strings.Join(cmd.Args, ` `))
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// kill the whole process group so that any children go away too
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+
+		log.Warningf("%v: command timed out after %v", self, timeout)
+		return self.errorResponse(name, http.StatusGatewayTimeout), nil
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if line != `` {
+			log.Warningf("  [%v] %s", tokens[0], line)
+		}
+	}
+
+	if stdout.Exceeded() {
+		log.Errorf("%v: command output exceeded %d bytes", self, stdout.Max)
+		return self.errorResponse(name, http.StatusBadGateway), nil
+	} else if err != nil {
+		log.Errorf("%v: command failed: %v", self, err)
+		return self.errorResponse(name, http.StatusInternalServerError), nil
+	}
+
+	return parseCgiResponse(name, stdout.Bytes())
+}
+
+func (self *ExecMount) maxOutputSize() int64 {
+	if self.MaxOutputSize > 0 {
+		return self.MaxOutputSize
+	} else {
+		return DefaultExecMaxOutputSize
+	}
+}
+
+func (self *ExecMount) acquire(ctx context.Context) (func(), error) {
+	if self.Concurrency <= 0 {
+		return func() {}, nil
+	}
+
+	self.slotsInit.Do(func() {
+		self.slots = make(chan bool, self.Concurrency)
+	})
+
+	select {
+	case self.slots <- true:
+		return func() {
+			<-self.slots
+		}, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timed out waiting for a free command slot")
+	}
+}
+
+// A buffer that refuses writes once it would grow larger than Max bytes.
+type cappedBuffer struct {
+	Max        int64
+	OnExceeded func()
+	buffer     bytes.Buffer
+	exceeded   int32
+}
+
+func (self *cappedBuffer) Write(p []byte) (int, error) {
+	if int64(self.buffer.Len()+len(p)) > self.Max {
+		if atomic.CompareAndSwapInt32(&self.exceeded, 0, 1) && self.OnExceeded != nil {
+			self.OnExceeded()
+		}
+
+		return 0, fmt.Errorf("output is larger than %d bytes", self.Max)
+	}
+
+	return self.buffer.Write(p)
+}
+
+func (self *cappedBuffer) Bytes() []byte {
+	return self.buffer.Bytes()
+}
+
+func (self *cappedBuffer) Exceeded() bool {
+	return atomic.LoadInt32(&self.exceeded) == 1
+}
+
+func (self *ExecMount) errorResponse(name string, code int) *MountResponse {
+	payload := bytes.NewReader([]byte(http.StatusText(code) + "\n"))
+	response := NewMountResponse(name, payload.Size(), payload)
+	response.StatusCode = code
+	response.ContentType = `text/plain`
+
+	return response
+}
+
+func (self *ExecMount) String() string {
+	return fmt.Sprintf("%T('%s' -> %v)", self, self.GetMountPoint(), self.Command)
+}
+
+// Check that the mount's program exists and is executable.
+func (self *ExecMount) Probe(timeout time.Duration) error {
+	tokens, err := shellwords.Parse(self.Command)
+
+	if err != nil {
+		return fmt.Errorf("invalid command: %v", err)
+	} else if len(tokens) == 0 {
+		return fmt.Errorf("no command specified")
+	}
+
+	program := tokens[0]
+
+	if strings.Contains(program, `/`) && !filepath.IsAbs(program) && self.Directory != `` {
+		if xdir, err := pathutil.ExpandUser(self.Directory); err == nil {
+			program = filepath.Join(xdir, program)
+		}
+	}
+
+	_, err = exec.LookPath(program)
+	return err
+}
+
+func (self *ExecMount) Open(name string) (http.File, error) {
+	return openAsHttpFile(self, name)
+}
+
+// Build the set of CGI/1.1 meta-variables (RFC 3875) describing the given request.
+func cgiEnvironment(mountPoint string, name string, req *http.Request, contentLength int) map[string]string {
+	env := map[string]string{
+		`GATEWAY_INTERFACE`: `CGI/1.1`,
+		`SERVER_SOFTWARE`:   fmt.Sprintf("diecast/%v", ApplicationVersion),
+		`SERVER_PROTOCOL`:   req.Proto,
+		`SERVER_NAME`:       req.Host,
+		`REQUEST_METHOD`:    req.Method,
+		`REQUEST_URI`:       req.URL.RequestURI(),
+		`SCRIPT_NAME`:       strings.TrimSuffix(mountPoint, `/`),
+		`PATH_INFO`:         strings.TrimPrefix(name, strings.TrimSuffix(mountPoint, `/`)),
+		`QUERY_STRING`:      req.URL.RawQuery,
+		`REMOTE_ADDR`:       req.RemoteAddr,
+		`CONTENT_TYPE`:      req.Header.Get(`Content-Type`),
+	}
+
+	if host, port, err := net.SplitHostPort(req.Host); err == nil {
+		env[`SERVER_NAME`] = host
+		env[`SERVER_PORT`] = port
+	}
+
+	if contentLength > 0 {
+		env[`CONTENT_LENGTH`] = strconv.Itoa(contentLength)
+	}
+
+	for key, values := range req.Header {
+		key = `HTTP_` + strings.ToUpper(strings.Replace(key, `-`, `_`, -1))
+
+		// per RFC 3875, these are exposed via other variables (or not at all)
+		switch key {
+		case `HTTP_CONTENT_TYPE`, `HTTP_CONTENT_LENGTH`, `HTTP_AUTHORIZATION`, `HTTP_PROXY`:
+			continue
+		}
+
+		env[key] = strings.Join(values, `, `)
+	}
+
+	return env
+}
+
+// Parse the output of a CGI program into a MountResponse.  If the output does not start with a
+// header block, the whole output is treated as the response body.
+func parseCgiResponse(name string, output []byte) (*MountResponse, error) {
+	var header textproto.MIMEHeader
+	body := output
+
+	if idx := bytes.Index(output, []byte("\n\n")); idx >= 0 || bytes.Contains(output, []byte("\r\n\r\n")) {
+		reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(output)))
+
+		if h, err := reader.ReadMIMEHeader(); err == nil && len(h) > 0 {
+			header = h
+			body, _ = ioutil.ReadAll(reader.R)
+		}
+	}
+
+	payload := bytes.NewReader(body)
+	response := NewMountResponse(name, payload.Size(), payload)
+
+	if header != nil {
+		if status := header.Get(`Status`); status != `` {
+			code, _ := stringutil.SplitPair(status, ` `)
+
+			if c, err := strconv.Atoi(code); err == nil {
+				response.StatusCode = c
+			} else {
+				return nil, fmt.Errorf("invalid Status header %q", status)
+			}
+		}
+
+		if location := header.Get(`Location`); location != `` {
+			response.RedirectTo = location
+
+			if response.StatusCode >= 300 && response.StatusCode < 400 {
+				response.RedirectCode = response.StatusCode
+			} else {
+				response.RedirectCode = http.StatusFound
+			}
+		}
+
+		if ct := header.Get(`Content-Type`); ct != `` {
+			response.ContentType = ct
+		}
+
+		for key, values := range header {
+			switch key {
+			case `Status`, `Location`, `Content-Type`, `Content-Length`:
+				continue
+			}
+
+			if len(values) > 1 {
+				response.Metadata[key] = values
+			} else {
+				response.Metadata[key] = values[0]
+			}
+		}
+	} else if mimetype, err := figureOutMimeType(name, payload); err == nil && mimetype != `` {
+		response.ContentType = mimetype
+	}
+
+	return response, nil
+}
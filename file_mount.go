@@ -8,15 +8,20 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/h2non/filetype"
 )
 
 type FileMount struct {
-	MountPoint  string          `json:"mount"`
-	Path        string          `json:"source"`
-	Passthrough bool            `json:"passthrough"`
-	FileSystem  http.FileSystem `json:"-"`
+	MountPoint   string          `json:"mount"`
+	Path         string          `json:"source"`
+	Passthrough  bool            `json:"passthrough"`
+	Writable     bool            `json:"writable"`
+	MaxWriteSize int64           `json:"max_write_size"`
+	FileSystem   http.FileSystem `json:"-"`
+	Autoindex    *bool           `json:"autoindex"`
+	MountMatcher
 }
 
 func (self *FileMount) GetMountPoint() string {
@@ -24,7 +29,7 @@ func (self *FileMount) GetMountPoint() string {
 }
 
 func (self *FileMount) WillRespondTo(name string, req *http.Request, requestBody io.Reader) bool {
-	return strings.HasPrefix(name, self.GetMountPoint())
+	return self.matches(self.GetMountPoint(), name, req)
 }
 
 func (self *FileMount) OpenWithType(name string, req *http.Request, requestBody io.Reader) (*MountResponse, error) {
@@ -34,7 +39,7 @@ func (self *FileMount) OpenWithType(name string, req *http.Request, requestBody
 		}
 	}
 
-	newPath := path.Join(strings.TrimSuffix(self.Path, `/`), strings.TrimPrefix(name, self.MountPoint))
+	newPath := path.Join(strings.TrimSuffix(self.Path, `/`), self.relativePath(self.MountPoint, name))
 
 	var file http.File
 	var err error
@@ -77,6 +82,20 @@ func (self *FileMount) String() string {
 	return fmt.Sprintf("%T('%s')", self, self.GetMountPoint())
 }
 
+// Check that the mount's source is available.
+func (self *FileMount) Probe(timeout time.Duration) error {
+	if self.FileSystem == nil {
+		_, err := os.Stat(self.Path)
+		return err
+	}
+
+	if root, err := self.FileSystem.Open(`/`); err == nil {
+		return root.Close()
+	} else {
+		return err
+	}
+}
+
 func (self *FileMount) Open(name string) (http.File, error) {
 	return openAsHttpFile(self, name)
 }
@@ -1,7 +1,10 @@
 module github.com/ghetzel/diecast
 
+go 1.27.1
+
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
+	github.com/andybalholm/brotli v1.1.1
 	github.com/dustin/go-humanize v0.0.0-20180713052910-9f541cc9db5d
 	github.com/fatih/structs v1.0.0
 	github.com/ghetzel/cli v1.17.0
@@ -14,14 +17,10 @@ require (
 	github.com/jbenet/go-base58 v0.0.0-20150317085156-6237cf65f3a6
 	github.com/julienschmidt/httprouter v0.0.0-20150421170007-8c199fb6259f
 	github.com/kelvins/sunrisesunset v0.0.0-20170601204625-14f1915ad4b4
-	github.com/mattn/go-runewidth v0.0.3 // indirect
 	github.com/mattn/go-shellwords v1.0.3
-	github.com/mcuadros/go-defaults v1.1.0 // indirect
 	github.com/microcosm-cc/bluemonday v1.0.0
 	github.com/montanaflynn/stats v0.0.0-20151014174947-eeaced052adb
 	github.com/russross/blackfriday/v2 v2.0.1
-	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24 // indirect
-	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	github.com/spaolacci/murmur3 v0.0.0-20170819071325-9f5d223c6079
 	github.com/stretchr/testify v1.2.2
 	github.com/tg123/go-htpasswd v0.0.0-20150618065153-49fe3fd1681b
@@ -31,5 +30,86 @@ require (
 	github.com/yosssi/gohtml v0.0.0-20180130040904-97fbf36f4aa8
 	golang.org/x/net v0.0.0-20190108225652-1e06a53dbb7e
 	golang.org/x/oauth2 v0.0.0-20190130055435-99b60b757ec1
+)
+
+require (
+	cloud.google.com/go v0.34.0 // indirect
+	github.com/andybalholm/cascadia v1.0.0 // indirect
+	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
+	github.com/c-bata/go-prompt v0.2.2 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dickeyxxx/netrc v0.0.0-20180207092346-e1a19c977509 // indirect
+	github.com/dsnet/compress v0.0.0-20171208185109-cc9eb1d7ad76 // indirect
+	github.com/erikstmartin/go-testdb v0.0.0-20160219214506-8d10e4a1bae5 // indirect
+	github.com/fatih/color v1.7.0 // indirect
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/ghetzel/argonaut v0.0.0-20180428155514-51604c68ce30 // indirect
+	github.com/ghetzel/friendscript v0.5.5 // indirect
+	github.com/ghetzel/go-defaults v1.2.0 // indirect
+	github.com/ghetzel/uuid v0.0.0-20171129191014-dec09d789f3d // indirect
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/google/btree v0.0.0-20180813153112-4030bb1f1f0c // indirect
+	github.com/google/go-cmp v0.2.0 // indirect
+	github.com/gorilla/websocket v1.4.0 // indirect
+	github.com/gregjones/httpcache v0.0.0-20180305231024-9cad4c3443a7 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.0.0 // indirect
+	github.com/hpcloud/tail v1.0.0 // indirect
+	github.com/husobee/vestigo v1.1.0 // indirect
+	github.com/jackpal/gateway v1.0.5-0.20180407163008-cbcf4e3f3bae // indirect
+	github.com/jdkato/prose v1.1.0 // indirect
+	github.com/jdxcode/netrc v0.0.0-20180207092346-e1a19c977509 // indirect
+	github.com/juliangruber/go-intersect v1.0.0 // indirect
+	github.com/k0kubun/colorstring v0.0.0-20150214042306-9440f1994b88 // indirect
+	github.com/kellydunn/golang-geo v0.7.0 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/kr/pty v1.1.1 // indirect
+	github.com/kr/text v0.1.0 // indirect
+	github.com/kylelemons/go-gypsy v0.0.0-20160905020020-08cad365cd28 // indirect
+	github.com/lib/pq v1.0.0 // indirect
+	github.com/mafredri/cdp v0.19.2 // indirect
+	github.com/magiconair/properties v1.8.0 // indirect
+	github.com/martinlindhe/unit v0.0.0-20180817222220-284ab7627fae // indirect
+	github.com/mattn/go-colorable v0.0.9 // indirect
+	github.com/mattn/go-isatty v0.0.4 // indirect
+	github.com/mattn/go-runewidth v0.0.3 // indirect
+	github.com/mattn/go-tty v0.0.0-20180219170247-931426f7535a // indirect
+	github.com/mcuadros/go-defaults v1.1.0 // indirect
+	github.com/mitchellh/go-ps v0.0.0-20170309133038-4fdf99ab2936 // indirect
+	github.com/mitchellh/mapstructure v1.0.0 // indirect
+	github.com/mjibson/esc v0.1.0 // indirect
+	github.com/neurosnap/sentences v1.0.6 // indirect
+	github.com/onsi/ginkgo v1.6.0 // indirect
+	github.com/onsi/gomega v1.4.2 // indirect
+	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7 // indirect
+	github.com/petar/GoLLRB v0.0.0-20130427215148-53be0d36a84c // indirect
+	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
+	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2 // indirect
+	github.com/pkg/term v0.0.0-20180730021639-bffc007b7fd5 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/pointlander/compress v1.1.0 // indirect
+	github.com/pointlander/jetset v1.0.0 // indirect
+	github.com/pointlander/peg v1.0.0 // indirect
+	github.com/russross/blackfriday v1.5.1 // indirect
+	github.com/sergi/go-diff v0.0.0-20140808132932-97b2266dfe4b // indirect
+	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	github.com/stretchrcom/testify v1.2.2 // indirect
+	github.com/xyproto/randomstring v1.0.5 // indirect
+	github.com/yudai/gojsondiff v0.0.0-20170107030110-7b1b7adf999d // indirect
+	github.com/yudai/golcs v0.0.0-20150405163532-d1c525dea8ce // indirect
+	github.com/yudai/pp v2.0.1+incompatible // indirect
+	github.com/ziutek/mymysql v1.5.4 // indirect
+	golang.org/x/sync v0.0.0-20181221193216-37e7f081c4d4 // indirect
+	golang.org/x/sys v0.0.0-20181107165924-66b7b1311ac8 // indirect
+	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/tools v0.0.0-20180917221912-90fa682c2a6e // indirect
+	google.golang.org/appengine v1.4.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/fsnotify.v1 v1.4.7 // indirect
+	gopkg.in/h2non/filetype.v1 v1.0.5 // indirect
+	gopkg.in/neurosnap/sentences.v1 v1.0.6 // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	gopkg.in/yaml.v2 v2.2.1 // indirect
 	launchpad.net/gocheck v0.0.0-20140225173054-000000000087 // indirect
 )
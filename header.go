@@ -53,6 +53,9 @@ type TemplateHeader struct {
 	// The built-in renderer to use when generating the page.
 	Renderer string `json:"renderer,omitempty"`
 
+	// Cache the rendered output of this page (see PageCacheConfig).
+	Cache *PageCacheConfig `json:"cache,omitempty"`
+
 	lines int
 }
 
@@ -74,6 +77,11 @@ func (self *TemplateHeader) Merge(other *TemplateHeader) (*TemplateHeader, error
 		newHeader.Redirect = redir
 	}
 
+	// Cache: prefer other, fallback to ours
+	if cache, ok := sliceutil.Or(other.Cache, self.Cache).(*PageCacheConfig); ok {
+		newHeader.Cache = cache
+	}
+
 	// maps: merge other's over top of ours
 
 	if v, err := maputil.Merge(self.Page, other.Page); err == nil {
@@ -0,0 +1,162 @@
+package diecast
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ghetzel/go-stockutil/sliceutil"
+)
+
+// Configures the endpoints that describe the server's configuration and state: /_diecast, /_bindings,
+// /_diecast/upstreams, /_diecast/commands, and /_diecast/cache.
+type IntrospectionConfig struct {
+	Enabled bool         `json:"enabled"`
+	Access  AccessPolicy `json:"access"` // who may use these endpoints (default: loopback addresses only)
+}
+
+// Replaces sensitive values in the output of introspection endpoints.
+var RedactedValue = `REDACTED`
+
+// Values of fields (or query string parameters) with names like these are redacted.
+var rxSensitiveKey = regexp.MustCompile(`(?i)^(.*[-_])?(secret|password|passwd|passphrase|token|api[-_]?key|private[-_]?key|credentials?|authorization)$`)
+
+// All values in maps with these names are redacted (e.g.: request headers, environment variables).
+var redactedMapKeys = []string{`headers`, `env`}
+
+// Return a handler that responds with the (redacted) JSON representation of the value returned by the
+// given function, provided introspection is enabled and the request is permitted by its access policy.
+func (self *Server) introspect(describe func(req *http.Request) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+
+		if !self.Introspection.Enabled {
+			http.Error(w, fmt.Sprintf("File %q was not found.", req.URL.Path), http.StatusNotFound)
+			return
+		} else if !self.Introspection.Access.permit(self, w, req) {
+			return
+		}
+
+		if output, err := redact(describe(req)); err == nil {
+			if data, err := json.Marshal(output); err == nil {
+				w.Header().Set(`Content-Type`, `application/json`)
+
+				if _, err := w.Write(data); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// Return a copy of the given value (as it would be encoded to JSON) with secrets removed: fields with
+// sensitive names, all header and environment variable values, and passwords in URLs.
+func redact(value interface{}) (interface{}, error) {
+	var output interface{}
+
+	if data, err := json.Marshal(value); err == nil {
+		if err := json.Unmarshal(data, &output); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	return redactValue(output, false), nil
+}
+
+func redactValue(value interface{}, all bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = redactValue(item, all || rxSensitiveKey.MatchString(key) || sliceutil.ContainsString(redactedMapKeys, strings.ToLower(key)))
+		}
+
+		return v
+
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item, all)
+		}
+
+		return v
+
+	case nil, bool:
+		return v
+
+	case string:
+		if v == `` {
+			return v
+		} else if all {
+			return RedactedValue
+		}
+
+		return redactURL(v)
+
+	default:
+		if all {
+			return RedactedValue
+		}
+
+		return v
+	}
+}
+
+var rxURL = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// Redact passwords and sensitive query string parameters from any URLs in the given text (e.g.: an
+// error message).
+func redactText(text string) string {
+	return rxURL.ReplaceAllStringFunc(text, redactURL)
+}
+
+// Redact the password and any sensitive query string parameters from the given URL.  Values that
+// aren't URLs are returned as-is.
+func redactURL(value string) string {
+	if !strings.Contains(value, `://`) {
+		return value
+	}
+
+	u, err := url.Parse(value)
+
+	if err != nil {
+		return value
+	}
+
+	var changed bool
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), RedactedValue)
+			changed = true
+		}
+	}
+
+	if u.RawQuery != `` {
+		query := u.Query()
+
+		for name := range query {
+			if rxSensitiveKey.MatchString(name) {
+				query.Set(name, RedactedValue)
+				changed = true
+			}
+		}
+
+		if changed {
+			u.RawQuery = query.Encode()
+		}
+	}
+
+	if changed {
+		return u.String()
+	}
+
+	return value
+}
@@ -0,0 +1,318 @@
+package diecast
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/timeutil"
+	"github.com/gobwas/glob"
+)
+
+// How often idle rate limit buckets are discarded.
+var RateLimitSweepInterval = time.Minute
+
+// Limits on how often clients may make requests, and how large those requests may be.
+type LimitsConfig struct {
+	Rate           []RateLimit `json:"rate"`           // token bucket rate limits for matching paths
+	TrustedProxies []string    `json:"trustedProxies"` // addresses or CIDR ranges of proxies whose X-Forwarded-For headers are trusted
+	MaxBodySize    int64       `json:"maxBodySize"`    // the largest request body (in bytes) that will be accepted
+	MaxHeaderSize  int         `json:"maxHeaderSize"`  // the largest request line and headers (in bytes) that will be accepted
+}
+
+// A token bucket rate limit: each client (as identified by the By field) may make bursts of up to
+// Burst requests, with the bucket refilling at the given rate.
+type RateLimit struct {
+	Paths     []string `json:"paths"`  // paths (which may contain wildcards) the limit applies to (default: all paths)
+	Except    []string `json:"except"` // paths the limit does not apply to
+	Rate      string   `json:"rate"`   // e.g.: "10/s", "300/m", "5000/h", or "20/30s"
+	Burst     int      `json:"burst"`  // the most requests that can be made at once (default: the number of requests in Rate)
+	By        string   `json:"by"`     // "ip" (default), "forwarded" (X-Forwarded-For from trusted proxies), or "user"
+	perSecond float64
+	capacity  float64
+	globs     []glob.Glob
+	except    []glob.Glob
+	buckets   map[string]*tokenBucket
+	swept     time.Time
+	lock      sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Parse and validate the rate limit.
+func (self *RateLimit) init() error {
+	count, period := self.Rate, `s`
+
+	if i := strings.Index(self.Rate, `/`); i >= 0 {
+		count, period = self.Rate[:i], self.Rate[i+1:]
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid rate %q", self.Rate)
+	}
+
+	var interval time.Duration
+
+	switch strings.TrimSpace(period) {
+	case `s`, `sec`, `second`:
+		interval = time.Second
+	case `m`, `min`, `minute`:
+		interval = time.Minute
+	case `h`, `hour`:
+		interval = time.Hour
+	case `d`, `day`:
+		interval = 24 * time.Hour
+	default:
+		if d, err := timeutil.ParseDuration(period); err == nil && d > 0 {
+			interval = d
+		} else {
+			return fmt.Errorf("invalid rate %q", self.Rate)
+		}
+	}
+
+	switch self.By {
+	case ``, `ip`, `forwarded`, `user`:
+	default:
+		return fmt.Errorf("unknown rate limit key %q", self.By)
+	}
+
+	self.perSecond = n / interval.Seconds()
+	self.capacity = math.Max(1, n)
+
+	if self.Burst > 0 {
+		self.capacity = float64(self.Burst)
+	}
+
+	self.globs = nil
+	self.except = nil
+
+	for _, pattern := range self.Paths {
+		if g, err := glob.Compile(pattern); err == nil {
+			self.globs = append(self.globs, g)
+		} else {
+			return fmt.Errorf("invalid path %q: %v", pattern, err)
+		}
+	}
+
+	for _, pattern := range self.Except {
+		if g, err := glob.Compile(pattern); err == nil {
+			self.except = append(self.except, g)
+		} else {
+			return fmt.Errorf("invalid path %q: %v", pattern, err)
+		}
+	}
+
+	self.buckets = make(map[string]*tokenBucket)
+	return nil
+}
+
+func (self *RateLimit) appliesTo(requestPath string) bool {
+	match := (len(self.globs) == 0)
+
+	for _, g := range self.globs {
+		if g.Match(requestPath) {
+			match = true
+			break
+		}
+	}
+
+	if match {
+		for _, g := range self.except {
+			if g.Match(requestPath) {
+				return false
+			}
+		}
+	}
+
+	return match
+}
+
+// Take a token from the given client's bucket.  If none are left, returns false along with how long
+// it will be until one is available.
+func (self *RateLimit) take(key string, now time.Time) (bool, time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.sweep(now)
+
+	if self.buckets == nil {
+		self.buckets = make(map[string]*tokenBucket)
+	}
+
+	bucket, ok := self.buckets[key]
+
+	if ok {
+		bucket.tokens = math.Min(self.capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*self.perSecond)
+		bucket.updated = now
+	} else {
+		bucket = &tokenBucket{
+			tokens:  self.capacity,
+			updated: now,
+		}
+
+		self.buckets[key] = bucket
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens -= 1
+		return true, 0
+	}
+
+	return false, time.Duration((1 - bucket.tokens) / self.perSecond * float64(time.Second))
+}
+
+// Discard the buckets of clients that have been idle long enough for their buckets to have refilled.
+func (self *RateLimit) sweep(now time.Time) {
+	if now.Sub(self.swept) < RateLimitSweepInterval {
+		return
+	}
+
+	self.swept = now
+
+	for key, bucket := range self.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*self.perSecond >= self.capacity {
+			delete(self.buckets, key)
+		}
+	}
+}
+
+func (self *Server) setupLimits() error {
+	for _, proxy := range self.Limits.TrustedProxies {
+		if _, err := parseNetwork(proxy); err != nil {
+			return fmt.Errorf("trusted proxies: %v", err)
+		}
+	}
+
+	for i := range self.Limits.Rate {
+		if err := self.Limits.Rate[i].init(); err != nil {
+			return fmt.Errorf("rate limit %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (self *LimitsConfig) trusts(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		for _, proxy := range self.TrustedProxies {
+			if network, err := parseNetwork(proxy); err == nil && network.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return the address of the client that made the given request.  If the request came from a trusted
+// proxy, this is the last address in the X-Forwarded-For header that isn't also a trusted proxy.
+func (self *LimitsConfig) clientAddress(req *http.Request) string {
+	client := remoteHost(req)
+
+	if !self.trusts(client) {
+		return client
+	}
+
+	hops := make([]string, 0)
+
+	for _, header := range req.Header.Values(`X-Forwarded-For`) {
+		for _, hop := range strings.Split(header, `,`) {
+			if hop = strings.TrimSpace(hop); hop != `` {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		client = hops[i]
+
+		if !self.trusts(client) {
+			break
+		}
+	}
+
+	return client
+}
+
+func (self *Server) rateLimitKey(limit *RateLimit, req *http.Request) string {
+	switch limit.By {
+	case `forwarded`:
+		return self.Limits.clientAddress(req)
+	case `user`:
+		if user := requestLog(req).User; user != `` {
+			return `user:` + user
+		}
+
+		// unauthenticated requests are limited by address
+		return self.Limits.clientAddress(req)
+	default:
+		return remoteHost(req)
+	}
+}
+
+// Apply the rate limits that match the given request, responding with an error if any have been
+// exceeded.  Limits keyed by user are applied once the request has been authenticated, the rest are
+// applied before the request is handled at all.  Returns whether the request may proceed.
+func (self *Server) allowRequest(w http.ResponseWriter, req *http.Request, authenticated bool) bool {
+	now := time.Now()
+
+	for i := range self.Limits.Rate {
+		limit := &self.Limits.Rate[i]
+
+		if (limit.By == `user`) != authenticated || !limit.appliesTo(req.URL.Path) {
+			continue
+		}
+
+		if ok, wait := limit.take(self.rateLimitKey(limit, req), now); !ok {
+			w.Header().Set(`Retry-After`, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			self.respondError(w, fmt.Errorf("Too many requests, please try again later."), http.StatusTooManyRequests)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Middleware that enforces request size limits and rate limits.
+func (self *Server) limitRequests(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if max := self.Limits.MaxHeaderSize; max > 0 && requestHeaderSize(req) > max {
+		self.respondError(w, fmt.Errorf("Request headers are too large."), http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	if max := self.Limits.MaxBodySize; max > 0 {
+		if req.ContentLength > max {
+			self.respondError(w, fmt.Errorf("Request body is too large (limit: %d bytes).", max), http.StatusRequestEntityTooLarge)
+			return
+		} else if req.Body != nil {
+			req.Body = http.MaxBytesReader(w, req.Body, max)
+		}
+	}
+
+	if self.allowRequest(w, req, false) {
+		next(w, req)
+	}
+}
+
+// The size of the request line and headers, as they were (approximately) sent.
+func requestHeaderSize(req *http.Request) int {
+	size := len(req.Method) + len(req.RequestURI) + len(req.Proto) + 4
+
+	for name, values := range req.Header {
+		for _, value := range values {
+			size += len(name) + len(value) + 4
+		}
+	}
+
+	return size
+}
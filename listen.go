@@ -0,0 +1,192 @@
+package diecast
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ghetzel/go-stockutil/log"
+)
+
+// The first file descriptor passed by systemd socket activation.
+var ListenFdsStart = 3
+
+// Returns whether the given address refers to a Unix domain socket (e.g.: "unix:/run/diecast.sock").
+func isUnixAddress(address string) bool {
+	return strings.HasPrefix(address, `unix:`)
+}
+
+// Return the addresses the server should listen on.
+func (self *Server) listenAddresses() []string {
+	addresses := make([]string, 0)
+
+	for _, address := range append([]string{self.Address}, self.Listeners...) {
+		if address != `` {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return addresses
+}
+
+// Create the listeners the server will accept connections from.  If the process was started via
+// systemd socket activation, the inherited sockets are used instead of the configured addresses.
+func (self *Server) listen() ([]net.Listener, error) {
+	if inherited, err := inheritedListeners(); err != nil {
+		return nil, err
+	} else if len(inherited) > 0 {
+		return inherited, nil
+	}
+
+	addresses := self.listenAddresses()
+	listeners := make([]net.Listener, 0)
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no addresses to listen on")
+	}
+
+	for _, address := range addresses {
+		if listener, err := self.listenOn(address); err == nil {
+			listeners = append(listeners, listener)
+		} else {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, err
+		}
+	}
+
+	return listeners, nil
+}
+
+func (self *Server) listenOn(address string) (net.Listener, error) {
+	if !isUnixAddress(address) {
+		return net.Listen(`tcp`, address)
+	}
+
+	socketPath := strings.TrimPrefix(address, `unix:`)
+
+	// remove sockets left behind by a previous process that didn't exit cleanly (but nothing else)
+	if stat, err := os.Lstat(socketPath); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%v: file exists and is not a socket", socketPath)
+		} else if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen(`unix`, socketPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if self.SocketMode != `` {
+		if mode, err := strconv.ParseUint(self.SocketMode, 8, 32); err == nil {
+			if err := os.Chmod(socketPath, os.FileMode(mode)); err != nil {
+				listener.Close()
+				return nil, err
+			}
+		} else {
+			listener.Close()
+			return nil, fmt.Errorf("invalid socket mode %q", self.SocketMode)
+		}
+	}
+
+	if self.SocketOwner != `` {
+		if uid, gid, err := lookupOwner(self.SocketOwner); err == nil {
+			if err := os.Chown(socketPath, uid, gid); err != nil {
+				listener.Close()
+				return nil, err
+			}
+		} else {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+// Parse an owner specification of the form "user", "user:group", or ":group" (names or numeric IDs)
+// into a UID and GID.  Omitted parts are returned as -1 (unchanged).
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	userName, groupName := owner, ``
+
+	if i := strings.Index(owner, `:`); i >= 0 {
+		userName, groupName = owner[:i], owner[i+1:]
+	}
+
+	if userName != `` {
+		if id, err := strconv.Atoi(userName); err == nil {
+			uid = id
+		} else if u, err := user.Lookup(userName); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		} else {
+			return -1, -1, err
+		}
+	}
+
+	if groupName != `` {
+		if id, err := strconv.Atoi(groupName); err == nil {
+			gid = id
+		} else if g, err := user.LookupGroup(groupName); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		} else {
+			return -1, -1, err
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// Return the listeners passed to this process via systemd socket activation (see sd_listen_fds(3)).
+// The environment variables are cleared so that child processes don't try to use them.
+func inheritedListeners() ([]net.Listener, error) {
+	fds := os.Getenv(`LISTEN_FDS`)
+
+	if fds == `` {
+		return nil, nil
+	}
+
+	if pid, err := strconv.Atoi(os.Getenv(`LISTEN_PID`)); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	defer func() {
+		os.Unsetenv(`LISTEN_PID`)
+		os.Unsetenv(`LISTEN_FDS`)
+		os.Unsetenv(`LISTEN_FDNAMES`)
+	}()
+
+	count, err := strconv.Atoi(fds)
+
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS value %q", fds)
+	}
+
+	listeners := make([]net.Listener, 0)
+
+	for fd := ListenFdsStart; fd < ListenFdsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("inherited file descriptor %d: %v", fd, err)
+		}
+
+		log.Infof("Using inherited listener %v", listener.Addr())
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,328 @@
+package diecast
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The path (beneath the route prefix) that metrics are served from.
+var MetricsPath = `/_diecast/metrics`
+
+// Upper bounds (in seconds) of the buckets used for latency histograms.
+var DefaultMetricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type MetricsConfig struct {
+	Enabled bool         `json:"enabled"` // serve metrics in the Prometheus text format
+	Access  AccessPolicy `json:"access"`  // who may read metrics (default: loopback addresses only)
+}
+
+// The metrics recorded as requests are handled (as opposed to those collected when scraped).  Each
+// server has its own, which the servers of its sites share.
+type metricsRegistry struct {
+	requests         *metric
+	requestDuration  *metric
+	bindingRequests  *metric
+	bindingErrors    *metric
+	bindingDuration  *metric
+	upstreamErrors   *metric
+	upstreamDuration *metric
+	templateParse    *metric
+	templateRender   *metric
+	authentications  *metric
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		requests:         newMetric(`counter`, `diecast_requests_total`, `Requests handled, by status and route.`, `status`, `route`),
+		requestDuration:  newMetric(`histogram`, `diecast_request_duration_seconds`, `Time taken to handle requests, by status and route.`, `status`, `route`),
+		bindingRequests:  newMetric(`counter`, `diecast_binding_requests_total`, `Requests made by bindings, by binding name.`, `binding`),
+		bindingErrors:    newMetric(`counter`, `diecast_binding_errors_total`, `Binding requests that failed or returned an error status, by binding name.`, `binding`),
+		bindingDuration:  newMetric(`histogram`, `diecast_binding_duration_seconds`, `Time taken for bindings to receive a response, by binding name.`, `binding`),
+		upstreamErrors:   newMetric(`counter`, `diecast_upstream_errors_total`, `Proxy mount requests that could not be sent to an upstream.`, `mount`, `upstream`),
+		upstreamDuration: newMetric(`histogram`, `diecast_upstream_duration_seconds`, `Time taken for proxy mount upstreams to respond.`, `mount`, `upstream`),
+		templateParse:    newMetric(`histogram`, `diecast_template_parse_duration_seconds`, `Time taken to parse templates, by engine.`, `engine`),
+		templateRender:   newMetric(`histogram`, `diecast_template_render_duration_seconds`, `Time taken to render templates, by engine.`, `engine`),
+		authentications:  newMetric(`counter`, `diecast_authentications_total`, `Authentication attempts, by authenticator type and outcome.`, `type`, `outcome`),
+	}
+}
+
+func (self *metricsRegistry) all() []*metric {
+	return []*metric{
+		self.requests,
+		self.requestDuration,
+		self.bindingRequests,
+		self.bindingErrors,
+		self.bindingDuration,
+		self.upstreamErrors,
+		self.upstreamDuration,
+		self.templateParse,
+		self.templateRender,
+		self.authentications,
+	}
+}
+
+// Returns the metrics registry of the server handling the given request, or nil if it isn't known
+// (e.g.: for requests made outside of a server.)
+func requestMetrics(req *http.Request) *metricsRegistry {
+	if req != nil {
+		if metrics, ok := req.Context().Value(`diecast-metrics`).(*metricsRegistry); ok {
+			return metrics
+		}
+	}
+
+	return nil
+}
+
+// Returns this server's metrics registry.
+func (self *Server) metricsRegistry() *metricsRegistry {
+	self.metricsInit.Do(func() {
+		if self.metrics == nil {
+			self.metrics = newMetricsRegistry()
+		}
+	})
+
+	return self.metrics
+}
+
+// A counter, gauge, or histogram, with a series of values for each distinct set of label values.
+type metric struct {
+	kind   string
+	name   string
+	help   string
+	labels []string
+	series map[string]*metricSeries
+	lock   sync.Mutex
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+}
+
+func newMetric(kind string, name string, help string, labels ...string) *metric {
+	return &metric{
+		kind:   kind,
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+}
+
+func (self *metric) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+
+	if series, ok := self.series[key]; ok {
+		return series
+	}
+
+	series := &metricSeries{
+		labels: labels,
+	}
+
+	if self.kind == `histogram` {
+		series.buckets = make([]uint64, len(DefaultMetricsBuckets)+1)
+	}
+
+	self.series[key] = series
+	return series
+}
+
+// Add to the value of a counter (or gauge).
+func (self *metric) Add(value float64, labels ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.get(labels).value += value
+}
+
+// Set the value of a gauge.
+func (self *metric) Set(value float64, labels ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.get(labels).value = value
+}
+
+// Record a duration in a histogram.
+func (self *metric) Observe(took time.Duration, labels ...string) {
+	seconds := took.Seconds()
+	bucket := sort.SearchFloat64s(DefaultMetricsBuckets, seconds)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	series := self.get(labels)
+	series.buckets[bucket]++
+	series.value += seconds
+}
+
+// Write the metric in the Prometheus text exposition format.
+func (self *metric) WriteTo(w io.Writer) (int64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "# HELP %s %s\n", self.name, self.help)
+	fmt.Fprintf(&out, "# TYPE %s %s\n", self.name, self.kind)
+
+	keys := make([]string, 0, len(self.series))
+
+	for key := range self.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := self.series[key]
+
+		if self.kind == `histogram` {
+			var count uint64
+
+			for i, n := range series.buckets {
+				count += n
+				le := math.Inf(1)
+
+				if i < len(DefaultMetricsBuckets) {
+					le = DefaultMetricsBuckets[i]
+				}
+
+				fmt.Fprintf(&out, "%s_bucket%s %d\n", self.name, self.labelSet(series.labels, `le`, formatMetricValue(le)), count)
+			}
+
+			fmt.Fprintf(&out, "%s_sum%s %s\n", self.name, self.labelSet(series.labels), formatMetricValue(series.value))
+			fmt.Fprintf(&out, "%s_count%s %d\n", self.name, self.labelSet(series.labels), count)
+		} else {
+			fmt.Fprintf(&out, "%s%s %s\n", self.name, self.labelSet(series.labels), formatMetricValue(series.value))
+		}
+	}
+
+	n, err := io.WriteString(w, out.String())
+	return int64(n), err
+}
+
+// Format label values as {name="value",...}, optionally followed by an extra name-value pair.
+func (self *metric) labelSet(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+1)
+
+	for i, value := range values {
+		if i < len(self.labels) {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", self.labels[i], labelEscaper.Replace(value)))
+		}
+	}
+
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[0], extra[1]))
+	}
+
+	if len(pairs) == 0 {
+		return ``
+	}
+
+	return `{` + strings.Join(pairs, `,`) + `}`
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return `+Inf`
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Collect metrics describing this server's caches.
+func (self *Server) cacheMetrics() []*metric {
+	hits := newMetric(`counter`, `diecast_cache_hits_total`, `Cache lookups that found a usable entry, by cache.`, `cache`)
+	misses := newMetric(`counter`, `diecast_cache_misses_total`, `Cache lookups that did not find a usable entry, by cache.`, `cache`)
+	ratio := newMetric(`gauge`, `diecast_cache_hit_ratio`, `The proportion of cache lookups that were hits, by cache.`, `cache`)
+	entries := newMetric(`gauge`, `diecast_cache_entries`, `The number of entries in each cache.`, `cache`)
+	stale := newMetric(`counter`, `diecast_cache_stale_total`, `Stale pages served from the page cache while being rendered again.`)
+
+	stats := self.TemplateCacheStats()
+	stats[`pages`] = self.PageCacheStats()
+
+	for name, stat := range stats {
+		hits.Set(float64(stat.Hits), name)
+		misses.Set(float64(stat.Misses), name)
+		entries.Set(float64(stat.Entries), name)
+
+		if lookups := stat.Hits + stat.Misses; lookups > 0 {
+			ratio.Set(float64(stat.Hits)/float64(lookups), name)
+		} else {
+			ratio.Set(0, name)
+		}
+	}
+
+	stale.Set(float64(stats[`pages`].Stale))
+
+	return []*metric{hits, misses, ratio, entries, stale}
+}
+
+// Write all metrics in the Prometheus text exposition format.
+func (self *Server) WriteMetrics(w io.Writer) error {
+	all := make([]*metric, 0)
+	all = append(all, self.metricsRegistry().all()...)
+	all = append(all, self.cacheMetrics()...)
+
+	for _, m := range all {
+		if _, err := m.WriteTo(w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (self *Server) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if !self.Metrics.Access.permit(self, w, req) {
+		return
+	}
+
+	w.Header().Set(`Content-Type`, `text/plain; version=0.0.4; charset=utf-8`)
+	self.WriteMetrics(w)
+}
+
+// The route label for a request is the route pattern, mount point, or template that handled it; these
+// are drawn from the configuration and the files being served, unlike the request path itself.
+func (self *accessLogEntry) route() string {
+	for _, route := range []string{self.Route, self.Mount, self.Template} {
+		if route != `` {
+			return route
+		}
+	}
+
+	return `-`
+}
+
+func (self *Server) observeRequest(status int, entry *accessLogEntry, took time.Duration) {
+	metrics := self.metricsRegistry()
+	code := strconv.Itoa(status)
+
+	metrics.requests.Add(1, code, entry.route())
+	metrics.requestDuration.Observe(took, code, entry.route())
+}
+
+func (self *Server) observeBinding(name string, took time.Duration, failed bool) {
+	metrics := self.metricsRegistry()
+
+	metrics.bindingRequests.Add(1, name)
+	metrics.bindingDuration.Observe(took, name)
+
+	if failed {
+		metrics.bindingErrors.Add(1, name)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"path/filepath"
 
+	"github.com/ghetzel/go-stockutil/log"
 	"github.com/ghetzel/go-stockutil/stringutil"
 )
 
@@ -26,6 +27,52 @@ type Mount interface {
 	String() string
 }
 
+// Mounts implementing StreamingMount can take over responding to requests that cannot be
+// buffered into a MountResponse (e.g.: WebSocket connections).
+type StreamingMount interface {
+	Mount
+	WillStream(*http.Request) bool
+	ServeStream(http.ResponseWriter, *http.Request, string) error
+}
+
+// Mounts implementing StartableMount have work to do in the background (e.g.: upstream health checks),
+// which begins when the server is initialized or a configuration reload adds them.
+type StartableMount interface {
+	Mount
+	Start() error
+}
+
+// Start the background work of any of the given mounts that have some.
+func startMounts(mounts []Mount) error {
+	for _, mount := range mounts {
+		if startable, ok := mount.(StartableMount); ok {
+			if err := startable.Start(); err != nil {
+				return fmt.Errorf("%v: %v", mount, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Mounts implementing ClosableMount do work in the background (e.g.: upstream health checks), which
+// stops when they are closed.
+type ClosableMount interface {
+	Mount
+	Close() error
+}
+
+// Close any of the given mounts that do work in the background.
+func closeMounts(mounts []Mount) {
+	for _, mount := range mounts {
+		if closable, ok := mount.(ClosableMount); ok {
+			if err := closable.Close(); err != nil {
+				log.Warningf("%v: failed to close: %v", mount, err)
+			}
+		}
+	}
+}
+
 func NewMountFromSpec(spec string) (Mount, error) {
 	mountPoint, source := stringutil.SplitPair(spec, `:`)
 
@@ -44,6 +91,14 @@ func NewMountFromSpec(spec string) (Mount, error) {
 			MountPoint: mountPoint,
 		}
 
+	case `exec`:
+		_, command := stringutil.SplitPair(source, `:`)
+
+		mount = &ExecMount{
+			Command:    command,
+			MountPoint: mountPoint,
+		}
+
 	default:
 		if absPath, err := filepath.Abs(source); err == nil {
 			source = absPath
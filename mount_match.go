@@ -0,0 +1,236 @@
+package diecast
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/gobwas/glob"
+)
+
+// A MountMatcher holds the options that control which requests a mount will respond to.  By default,
+// a mount responds to any request whose path starts with the mount point.  If a glob or regular
+// expression pattern is given, it is used to match the request path instead.  Methods, hosts, and
+// headers further restrict which requests are considered.
+type MountMatcher struct {
+	Match        string            `json:"match,omitempty"`
+	MatchRegex   string            `json:"match_regex,omitempty"`
+	Methods      []string          `json:"methods,omitempty"`
+	MatchHosts   []string          `json:"match_hosts,omitempty"`
+	MatchHeaders map[string]string `json:"match_headers,omitempty"`
+	Priority     int               `json:"priority,omitempty"`
+	LocalFirst   *bool             `json:"local_first,omitempty"`
+	compileOnce  sync.Once
+	glob         glob.Glob
+	rx           *regexp.Regexp
+	hostGlobs    []glob.Glob
+	headerGlobs  map[string]glob.Glob
+}
+
+// Mounts that embed a MountMatcher expose it through this interface.
+type matchableMount interface {
+	matcher() *MountMatcher
+}
+
+func (self *MountMatcher) matcher() *MountMatcher {
+	return self
+}
+
+func (self *MountMatcher) compile() {
+	self.compileOnce.Do(func() {
+		if self.Match != `` {
+			if g, err := glob.Compile(self.Match, '/'); err == nil {
+				self.glob = g
+			} else {
+				log.Errorf("invalid mount match pattern %q: %v", self.Match, err)
+			}
+		}
+
+		if self.MatchRegex != `` {
+			if rx, err := regexp.Compile(self.MatchRegex); err == nil {
+				self.rx = rx
+			} else {
+				log.Errorf("invalid mount match expression %q: %v", self.MatchRegex, err)
+			}
+		}
+
+		self.hostGlobs = compileHeaderGlobs(self.MatchHosts)
+		self.headerGlobs = make(map[string]glob.Glob)
+
+		for header, pattern := range self.MatchHeaders {
+			if g, err := glob.Compile(pattern); err == nil {
+				self.headerGlobs[header] = g
+			} else {
+				log.Errorf("invalid mount header pattern %q: %v", pattern, err)
+			}
+		}
+	})
+}
+
+// Returns whether a mount at the given mount point should respond to the given path and request.
+// Method, host, and header conditions are only checked if a request is given.
+func (self *MountMatcher) matches(mountPoint string, name string, req *http.Request) bool {
+	self.compile()
+
+	if self.Match != `` || self.MatchRegex != `` {
+		if self.Match != `` && (self.glob == nil || !self.glob.Match(name)) {
+			return false
+		}
+
+		if self.MatchRegex != `` && (self.rx == nil || !self.rx.MatchString(name)) {
+			return false
+		}
+	} else if !strings.HasPrefix(name, mountPoint) {
+		return false
+	}
+
+	if req == nil {
+		return true
+	}
+
+	if len(self.Methods) > 0 {
+		allowed := false
+
+		for _, method := range self.Methods {
+			if strings.EqualFold(method, req.Method) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	if len(self.MatchHosts) > 0 {
+		host := req.Host
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		allowed := false
+
+		for _, g := range self.hostGlobs {
+			if g.Match(strings.ToLower(host)) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	// headers with invalid patterns never match
+	for header := range self.MatchHeaders {
+		if value := req.Header.Get(header); value == `` {
+			return false
+		} else if g, ok := self.headerGlobs[header]; !ok || !g.Match(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the portion of the given request path that the mount's own paths are relative to.  This is
+// the mount point for paths beneath it; paths matched by a pattern from elsewhere are relative to the
+// directory part of the pattern's literal prefix (or to the root if the pattern has none.)
+func (self *MountMatcher) basePath(mountPoint string, name string) string {
+	if self.Match == `` && self.MatchRegex == `` {
+		return mountPoint
+	} else if isUnderPath(name, mountPoint) {
+		return mountPoint
+	}
+
+	var prefix string
+
+	if self.Match != `` {
+		if i := strings.IndexAny(self.Match, `*?[{\`); i >= 0 {
+			prefix = self.Match[:i]
+		} else {
+			prefix = self.Match
+		}
+	} else if strings.HasPrefix(self.MatchRegex, `^`) {
+		if rx, err := regexp.Compile(strings.TrimPrefix(self.MatchRegex, `^`)); err == nil {
+			prefix, _ = rx.LiteralPrefix()
+		}
+	}
+
+	if i := strings.LastIndex(prefix, `/`); i >= 0 && strings.HasPrefix(name, prefix[:i+1]) {
+		return prefix[:i+1]
+	}
+
+	return ``
+}
+
+// Returns the given request path relative to the mount (see basePath).
+func (self *MountMatcher) relativePath(mountPoint string, name string) string {
+	return strings.TrimPrefix(name, self.basePath(mountPoint, name))
+}
+
+// Returns whether the given name is the given path or beneath it.
+func isUnderPath(name string, dir string) bool {
+	if dir == `` || !strings.HasPrefix(name, dir) {
+		return false
+	}
+
+	return strings.HasSuffix(dir, `/`) || len(name) == len(dir) || name[len(dir)] == '/'
+}
+
+// Returns the priority of the given mount, or zero if the mount does not specify one.
+func mountPriority(mount Mount) int {
+	if m, ok := mount.(matchableMount); ok {
+		return m.matcher().Priority
+	}
+
+	return 0
+}
+
+// Returns the mounts in the order they should be consulted (see sortMounts).
+func (self *Server) sortedMounts() []Mount {
+	return self.mountOrder
+}
+
+// Determine the order the mounts should be consulted in: highest priority first, then the most
+// specific (longest) mount point, then in the order they were declared.  This is done whenever the
+// mounts change rather than on every request.
+func (self *Server) sortMounts() {
+	mounts := make([]Mount, len(self.Mounts))
+	copy(mounts, self.Mounts)
+
+	sort.SliceStable(mounts, func(i, j int) bool {
+		if pi, pj := mountPriority(mounts[i]), mountPriority(mounts[j]); pi != pj {
+			return pi > pj
+		}
+
+		return len(mounts[i].GetMountPoint()) > len(mounts[j].GetMountPoint())
+	})
+
+	self.mountOrder = mounts
+}
+
+// Returns whether the local filesystem should be consulted before the mounts for the given path.
+// The first mount that would respond to the request may override the server-wide setting.
+func (self *Server) localFirstFor(requestPath string, req *http.Request) bool {
+	for _, mount := range self.sortedMounts() {
+		if mount.WillRespondTo(requestPath, req, nil) {
+			if m, ok := mount.(matchableMount); ok {
+				if lf := m.matcher().LocalFirst; lf != nil {
+					return *lf
+				}
+			}
+
+			break
+		}
+	}
+
+	return self.TryLocalFirst
+}
@@ -17,6 +17,8 @@ type MountResponse struct {
 	payload      interface{}
 	name         string
 	size         int64
+	modTime      time.Time
+	streaming    bool
 }
 
 func NewMountResponse(name string, size int64, payload interface{}) *MountResponse {
@@ -42,9 +44,17 @@ func (self *MountResponse) GetFile() http.File {
 	}
 }
 
+// Returns whether this response is a stream whose payload should be passed on to the client as it is
+// read rather than buffered.
+func (self *MountResponse) IsStream() bool {
+	return self.streaming
+}
+
 func (self *MountResponse) Read(p []byte) (int, error) {
 	if self.payload == nil {
 		return 0, fmt.Errorf("Cannot read from closed response")
+	} else if reader, ok := self.payload.(io.Reader); ok && self.streaming {
+		return reader.Read(p)
 	} else if reader, ok := self.payload.(io.ReadSeeker); ok {
 		return reader.Read(p)
 	} else {
@@ -61,8 +71,14 @@ func (self *MountResponse) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (self *MountResponse) Close() error {
+	var err error
+
+	if closer, ok := self.payload.(io.Closer); ok && self.streaming {
+		err = closer.Close()
+	}
+
 	self.payload = nil
-	return nil
+	return err
 }
 
 func (self *MountResponse) Readdir(count int) ([]os.FileInfo, error) {
@@ -81,8 +97,16 @@ func (self *MountResponse) Mode() os.FileMode {
 	return 0666
 }
 
+// Returns the modification time of the underlying file (if the payload is a file), or the time
+// reported by the mount that generated this response.  A zero time is returned if neither is known.
 func (self *MountResponse) ModTime() time.Time {
-	return time.Now()
+	if file, ok := self.payload.(http.File); ok && file != nil {
+		if stat, err := file.Stat(); err == nil {
+			return stat.ModTime()
+		}
+	}
+
+	return self.modTime
 }
 
 func (self *MountResponse) IsDir() bool {
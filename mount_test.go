@@ -1,11 +1,15 @@
 package diecast
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -115,3 +119,465 @@ func TestMounts(t *testing.T) {
 	_, err = mount.Open(`/fs-test/NOPE`)
 	assert.Equal(os.ErrNotExist, err)
 }
+
+func TestProxyMountUpstreams(t *testing.T) {
+	assert := require.New(t)
+
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+
+	one := newUpstream(`one`)
+	defer one.Close()
+	two := newUpstream(`two`)
+	three := newUpstream(`three`)
+	defer three.Close()
+
+	mount := &ProxyMount{
+		MountPoint: `/`,
+		URL:        one.URL,
+		Upstreams:  []string{two.URL, three.URL},
+	}
+
+	seen := make(map[string]int)
+
+	for i := 0; i < 6; i++ {
+		response, err := mount.OpenWithType(`/`, nil, nil)
+		assert.Nil(err)
+
+		data, err := ioutil.ReadAll(response)
+		assert.Nil(err)
+		seen[string(data)] += 1
+	}
+
+	assert.Equal(map[string]int{`one`: 2, `two`: 2, `three`: 2}, seen)
+
+	// take an upstream away; requests should fail over and eventually mark it down
+	two.Close()
+
+	for i := 0; i < 9; i++ {
+		response, err := mount.OpenWithType(`/`, nil, nil)
+		assert.Nil(err)
+
+		data, err := ioutil.ReadAll(response)
+		assert.Nil(err)
+		assert.NotEqual(`two`, string(data))
+	}
+
+	for _, status := range mount.UpstreamStatus() {
+		if status.URL == two.URL {
+			assert.False(status.Healthy)
+			assert.NotEmpty(status.LastError)
+		} else {
+			assert.True(status.Healthy)
+		}
+	}
+
+	// health checks stop once the mount is closed
+	var checks int64
+
+	checked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&checks, 1)
+	}))
+
+	defer checked.Close()
+
+	mount = &ProxyMount{
+		MountPoint: `/`,
+		URL:        checked.URL,
+		Upstreams:  []string{checked.URL + `/other`},
+		Balance:    `fastest`,
+		HealthCheck: ProxyHealthCheck{
+			Path:     `/healthz`,
+			Interval: `10ms`,
+		},
+	}
+
+	assert.Nil(mount.Start())
+	assert.Equal(BalanceRoundRobin, mount.balance)
+	assert.Equal(`fastest`, mount.Balance)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(mount.Close())
+	time.Sleep(20 * time.Millisecond)
+
+	stopped := atomic.LoadInt64(&checks)
+	assert.True(stopped > 0)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(stopped, atomic.LoadInt64(&checks))
+
+	// health checks start with the server (even for a single upstream), and an upstream that fails
+	// them stays out of rotation until one passes
+	var healthy int64
+
+	single := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == `/healthz` && atomic.LoadInt64(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.Write([]byte(`single`))
+		}
+	}))
+
+	defer single.Close()
+
+	mount = &ProxyMount{
+		MountPoint: `/`,
+		URL:        single.URL,
+		HealthCheck: ProxyHealthCheck{
+			Path:     `/healthz`,
+			Interval: `10ms`,
+		},
+	}
+
+	defer mount.Close()
+
+	server := NewServer(`./tests/hello`)
+	server.SetMounts([]Mount{mount})
+	assert.Nil(server.Initialize())
+
+	waitFor := func(healthy bool) ProxyUpstream {
+		for i := 0; i < 100; i++ {
+			if status := mount.UpstreamStatus()[0]; !status.LastChecked.IsZero() && status.Healthy == healthy {
+				return status
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		return mount.UpstreamStatus()[0]
+	}
+
+	status := waitFor(false)
+	assert.False(status.LastChecked.IsZero())
+	assert.False(status.Healthy)
+
+	_, err := mount.OpenWithType(`/`, nil, nil)
+	assert.Error(err)
+	assert.Error(mount.Probe(time.Second))
+
+	time.Sleep(50 * time.Millisecond)
+	_, err = mount.OpenWithType(`/`, nil, nil)
+	assert.Error(err)
+
+	atomic.StoreInt64(&healthy, 1)
+	assert.True(waitFor(true).Healthy)
+	assert.Nil(mount.Probe(time.Second))
+
+	response, err := mount.OpenWithType(`/`, nil, nil)
+	assert.Nil(err)
+
+	data, err := ioutil.ReadAll(response)
+	assert.Nil(err)
+	assert.Equal(`single`, string(data))
+}
+
+func TestMountConfigOptions(t *testing.T) {
+	assert := require.New(t)
+
+	config, err := ioutil.TempFile(``, `diecast-test-`)
+	assert.Nil(err)
+	defer os.Remove(config.Name())
+
+	_, err = config.Write([]byte("mounts:\n" +
+		"- mount: /api/\n" +
+		"  to:    http://10.0.0.1:8080\n" +
+		"  options:\n" +
+		"    passthrough_requests: true\n" +
+		"    balance: least-conn\n" +
+		"    upstreams: [http://10.0.0.2:8080]\n" +
+		"    health_check:\n" +
+		"      path: /healthz\n" +
+		"- mount: /uploads/\n" +
+		"  to:    /tmp\n" +
+		"  options:\n" +
+		"    writable:       true\n" +
+		"    max_write_size: 1024\n" +
+		"    autoindex:      true\n" +
+		"    match:          /uploads/*.txt\n" +
+		"    methods:        [GET, PUT]\n" +
+		"    priority:       5\n",
+	))
+	assert.Nil(err)
+	assert.Nil(config.Close())
+
+	server := NewServer(`./tests/hello`)
+	assert.Nil(server.LoadConfig(config.Name()))
+	assert.Len(server.Mounts, 2)
+
+	mount, ok := server.Mounts[0].(*ProxyMount)
+	assert.True(ok)
+	assert.Equal(`/api/`, mount.GetMountPoint())
+	assert.Equal(`http://10.0.0.1:8080`, mount.URL)
+	assert.True(mount.PassthroughRequests)
+	assert.Equal(`least-conn`, mount.Balance)
+
+	// lists, nested options, numbers, and options of embedded structs all apply
+	assert.Equal([]string{`http://10.0.0.2:8080`}, mount.Upstreams)
+	assert.Equal(`/healthz`, mount.HealthCheck.Path)
+
+	fileMount, ok := server.Mounts[1].(*FileMount)
+	assert.True(ok)
+	assert.True(fileMount.Writable)
+	assert.Equal(int64(1024), fileMount.MaxWriteSize)
+	assert.NotNil(fileMount.Autoindex)
+	assert.True(*fileMount.Autoindex)
+	assert.Equal(`/uploads/*.txt`, fileMount.Match)
+	assert.Equal([]string{`GET`, `PUT`}, fileMount.Methods)
+	assert.Equal(5, fileMount.Priority)
+
+	// options of the wrong type are reported
+	assert.Error(server.loadConfigData([]byte("mounts:\n- mount: /x/\n  to: /tmp\n  options:\n    methods: GET\n")))
+}
+
+func TestProxyMountRewriting(t *testing.T) {
+	assert := require.New(t)
+	var upstreamURL string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case `/login`:
+			http.SetCookie(w, &http.Cookie{
+				Name:   `session`,
+				Value:  `abc`,
+				Path:   `/account`,
+				Domain: `backend.internal`,
+			})
+
+			http.Redirect(w, req, upstreamURL+`/account/home?x=1`, http.StatusFound)
+		case `/page`:
+			w.Header().Set(`Content-Type`, `text/html`)
+			w.Header().Set(`X-Backend-Secret`, `hunter2`)
+			w.Header().Set(`X-Backend-Version`, `1.2.3`)
+			w.Write([]byte(`<a href="/about">About</a><img src='` + upstreamURL + `/logo.png'><a href="https://example.com/">x</a>`))
+		}
+	}))
+
+	defer upstream.Close()
+	upstreamURL = upstream.URL
+
+	mount := &ProxyMount{
+		MountPoint:          `/app/`,
+		URL:                 upstream.URL,
+		PassthroughRequests: true,
+		StripPathPrefix:     `/app`,
+		RewriteRedirects:    true,
+		RewriteCookies:      true,
+		RewriteHTML:         true,
+		DenyResponseHeaders: []string{`x-backend-secret`},
+	}
+
+	req := httptest.NewRequest(`GET`, `/app/login`, nil)
+	response, err := mount.OpenWithType(`/app/login`, req, nil)
+	assert.Nil(err)
+	assert.Equal(http.StatusFound, response.StatusCode)
+	assert.Equal(`/app/account/home?x=1`, response.Metadata[`Location`])
+	assert.Equal([]string{`session=abc; Path=/app/account`}, response.Metadata[`Set-Cookie`])
+
+	req = httptest.NewRequest(`GET`, `/app/page`, nil)
+	response, err = mount.OpenWithType(`/app/page`, req, nil)
+	assert.Nil(err)
+
+	data, err := ioutil.ReadAll(response)
+	assert.Nil(err)
+	assert.Equal(`<a href="/app/about">About</a><img src='/app/logo.png'><a href="https://example.com/">x</a>`, string(data))
+	assert.Nil(response.Metadata[`X-Backend-Secret`])
+	assert.Equal(`1.2.3`, response.Metadata[`X-Backend-Version`])
+}
+
+func TestExecMount(t *testing.T) {
+	assert := require.New(t)
+
+	mount, err := NewMountFromSpec(`/cgi/:exec:sh -c 'printf "Status: 201 Created\r\nContent-Type: text/plain\r\nX-Test: yes\r\n\r\n%s %s %s %s" "$REQUEST_METHOD" "$PATH_INFO" "$QUERY_STRING" "$(cat)"'`)
+	assert.Nil(err)
+
+	execMount, ok := mount.(*ExecMount)
+	assert.True(ok)
+	assert.Equal(`/cgi/`, execMount.GetMountPoint())
+
+	req := httptest.NewRequest(`POST`, `/cgi/run/this?x=1`, nil)
+	response, err := mount.OpenWithType(`/cgi/run/this`, req, bytes.NewBufferString(`body`))
+	assert.Nil(err)
+	assert.Equal(201, response.StatusCode)
+	assert.Equal(`text/plain`, response.ContentType)
+	assert.Equal(`yes`, response.Metadata[`X-Test`])
+
+	data, err := ioutil.ReadAll(response)
+	assert.Nil(err)
+	assert.Equal(`POST /run/this x=1 body`, string(data))
+
+	// commands that take too long are killed
+	execMount.Command = `sleep 5`
+	execMount.Timeout = `100ms`
+
+	response, err = mount.OpenWithType(`/cgi/slow`, req, nil)
+	assert.Nil(err)
+	assert.Equal(http.StatusGatewayTimeout, response.StatusCode)
+
+	// failing commands produce a server error
+	execMount.Command = `false`
+	execMount.Timeout = ``
+
+	response, err = mount.OpenWithType(`/cgi/fail`, req, nil)
+	assert.Nil(err)
+	assert.Equal(http.StatusInternalServerError, response.StatusCode)
+
+	// commands that produce too much output are killed
+	execMount.Command = `sh -c 'printf "\r\n"; while true; do echo xxxxxxxxxxxxxxxx; done'`
+	execMount.MaxOutputSize = 1024
+
+	response, err = mount.OpenWithType(`/cgi/loud`, req, nil)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadGateway, response.StatusCode)
+
+	// JSON input carries the body base64-encoded, so binary bodies arrive intact
+	execMount.Command = `cat`
+	execMount.Input = `json`
+	execMount.MaxOutputSize = 0
+
+	response, err = mount.OpenWithType(`/cgi/json`, req, bytes.NewReader([]byte{0xff, 0x00, 0xfe}))
+	assert.Nil(err)
+
+	data, err = ioutil.ReadAll(response)
+	assert.Nil(err)
+	assert.Contains(string(data), `"body":"/wD+"`)
+}
+
+func TestMountMatching(t *testing.T) {
+	assert := require.New(t)
+
+	mount := &FileMount{
+		MountPoint: `/assets/`,
+		Path:       `./tests/external_path`,
+	}
+
+	mount.Match = `/assets/**/*.js`
+	assert.True(mount.WillRespondTo(`/assets/js/jquery.min.js`, nil, nil))
+	assert.False(mount.WillRespondTo(`/assets/css/bootstrap.min.css`, nil, nil))
+
+	mount = &FileMount{
+		MountPoint: `/api/`,
+		Path:       `./tests/external_path`,
+	}
+
+	mount.MatchRegex = `^/api/v[0-9]+/`
+	mount.Methods = []string{`get`, `head`}
+	mount.MatchHosts = []string{`*.example.com`}
+	mount.MatchHeaders = map[string]string{
+		`X-Api-Client`: `test-*`,
+	}
+
+	req := httptest.NewRequest(`GET`, `http://api.example.com:8080/api/v2/things`, nil)
+	req.Header.Set(`X-Api-Client`, `test-suite`)
+
+	assert.True(mount.WillRespondTo(`/api/v2/things`, req, nil))
+	assert.False(mount.WillRespondTo(`/api/things`, req, nil))
+
+	req.Header.Set(`X-Api-Client`, `other`)
+	assert.False(mount.WillRespondTo(`/api/v2/things`, req, nil))
+
+	req.Header.Set(`X-Api-Client`, `test-suite`)
+	req.Method = `POST`
+	assert.False(mount.WillRespondTo(`/api/v2/things`, req, nil))
+
+	req.Method = `GET`
+	req.Host = `example.org`
+	assert.False(mount.WillRespondTo(`/api/v2/things`, req, nil))
+
+	// patterns are compiled once; invalid ones never match
+	mount = &FileMount{
+		MountPoint: `/api/`,
+		Path:       `./tests/external_path`,
+	}
+
+	mount.MatchHeaders = map[string]string{
+		`X-Api-Client`: `test-[`,
+	}
+
+	req.Host = `api.example.com`
+	req.Header.Set(`X-Api-Client`, `test-[`)
+	assert.False(mount.WillRespondTo(`/api/v2/things`, req, nil))
+	assert.Len(mount.headerGlobs, 0)
+}
+
+func TestMountPriority(t *testing.T) {
+	assert := require.New(t)
+
+	general := &FileMount{MountPoint: `/assets/js/`, Path: `./tests/external_path/js`}
+	vendor := &FileMount{MountPoint: `/assets/js/vendor/`, Path: `./tests/external_path/js`}
+	other := &FileMount{MountPoint: `/css/`, Path: `./tests/external_path/css`}
+
+	server := NewServer(`./tests/hello`)
+	server.SetMounts([]Mount{general, other, vendor})
+
+	// more specific mount points are consulted first, regardless of declaration order
+	mounts := server.sortedMounts()
+	assert.Equal([]Mount{vendor, general, other}, mounts)
+
+	req := httptest.NewRequest(`GET`, `/assets/js/vendor/jquery.min.js`, nil)
+	mount, _, err := server.tryMounts(`/assets/js/vendor/jquery.min.js`, req)
+	assert.Nil(err)
+	assert.Equal(vendor, mount)
+
+	// ...unless priority says otherwise
+	other.Priority = 10
+	general.Priority = 5
+	server.sortMounts()
+
+	mounts = server.sortedMounts()
+	assert.Equal([]Mount{other, general, vendor}, mounts)
+
+	// per-mount local_first overrides the server setting
+	assert.False(server.localFirstFor(`/assets/js/jquery.min.js`, req))
+
+	localFirst := true
+	general.LocalFirst = &localFirst
+	assert.True(server.localFirstFor(`/assets/js/jquery.min.js`, req))
+	assert.False(server.localFirstFor(`/css/bootstrap.min.css`, req))
+}
+
+func TestMountMatchPaths(t *testing.T) {
+	assert := require.New(t)
+
+	// paths beneath the mount point are relative to it, whether or not a pattern matched them
+	mount := &FileMount{MountPoint: `/assets/js/`, Path: `./tests/external_path/js`}
+	mount.Match = `/assets/**/*.js`
+	assert.Equal(`jquery.min.js`, mount.relativePath(mount.MountPoint, `/assets/js/jquery.min.js`))
+
+	// ...and anything else the pattern matched is relative to the pattern's literal directory
+	assert.Equal(`vendor/x.js`, mount.relativePath(mount.MountPoint, `/assets/vendor/x.js`))
+
+	mount.Match = `/assets/js*/*.js`
+	assert.Equal(`jsx/x.js`, mount.relativePath(mount.MountPoint, `/assets/jsx/x.js`))
+
+	server := NewServer(`./tests/hello`)
+	globMount := &FileMount{MountPoint: `/files/`, Path: `./tests/external_path/testfiles`}
+	globMount.Match = `/pages/**/*.html`
+
+	rxMount := &FileMount{MountPoint: `/files/`, Path: `./tests/external_path/testfiles`}
+	rxMount.MatchRegex = `^/docs/subdir[0-9]/`
+
+	server.SetMounts([]Mount{globMount, rxMount})
+	server.Autoindex.Enabled = true
+	assert.Nil(server.Initialize())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(`GET`, path, nil))
+		return w
+	}
+
+	w := get(`/pages/subdir1/test.html`)
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), `<h1>GET</h1>`)
+
+	w = get(`/docs/subdir2/index.html`)
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), `INDEX GET`)
+
+	w = get(`/docs/subdir1/`)
+	assert.Equal(200, w.Code)
+	assert.Contains(w.Body.String(), `href="test.html"`)
+}
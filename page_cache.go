@@ -0,0 +1,352 @@
+package diecast
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/sliceutil"
+	"github.com/ghetzel/go-stockutil/timeutil"
+)
+
+// The default number of rendered pages to keep in memory.
+var DefaultPageCacheSize = 1024
+
+// The response header indicating whether a page was served from the cache (HIT, STALE, or MISS).
+var PageCacheHeader = `X-Diecast-Cache`
+
+// Configures caching of the rendered output of a page.  Pages are only cached when they are
+// requested with GET or HEAD and rendered successfully (HTTP 200) without setting any cookies.
+type PageCacheConfig struct {
+	// How long a rendered page is served from the cache before it is rendered again (e.g.: "5m").
+	TTL string `json:"ttl,omitempty"`
+
+	// How long after the TTL has passed that the cached page may still be served while a fresh copy is rendered in the background.
+	StaleWhileRevalidate string `json:"stale_while_revalidate,omitempty"`
+
+	// Query string parameters whose values are part of the cache key (in addition to the host and path).
+	Query []string `json:"query,omitempty"`
+
+	// Request headers whose values are part of the cache key.
+	Headers []string `json:"headers,omitempty"`
+
+	// Cookies whose values are part of the cache key.
+	Cookies []string `json:"cookies,omitempty"`
+
+	// Tags that can be used to purge groups of pages from the cache (may contain template expressions).
+	Tags []string `json:"tags,omitempty"`
+}
+
+func (self *PageCacheConfig) ttl() time.Duration {
+	if d, err := timeutil.ParseDuration(self.TTL); err == nil && d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+func (self *PageCacheConfig) staleWhileRevalidate() time.Duration {
+	if d, err := timeutil.ParseDuration(self.StaleWhileRevalidate); err == nil && d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+// Return the key the given request's response is cached under.
+func (self *PageCacheConfig) key(req *http.Request) string {
+	parts := []string{req.Host, req.URL.Path}
+	query := req.URL.Query()
+
+	for _, name := range self.Query {
+		parts = append(parts, fmt.Sprintf("q:%s=%s", name, strings.Join(query[name], `,`)))
+	}
+
+	for _, name := range self.Headers {
+		parts = append(parts, fmt.Sprintf("h:%s=%s", http.CanonicalHeaderKey(name), strings.Join(req.Header[http.CanonicalHeaderKey(name)], `,`)))
+	}
+
+	for _, name := range self.Cookies {
+		if cookie, err := req.Cookie(name); err == nil {
+			parts = append(parts, fmt.Sprintf("c:%s=%s", name, cookie.Value))
+		} else {
+			parts = append(parts, fmt.Sprintf("c:%s", name))
+		}
+	}
+
+	return strings.Join(parts, "\n")
+}
+
+type cachedPage struct {
+	path       string
+	tags       []string
+	status     int
+	header     http.Header
+	body       []byte
+	nonce      string
+	stored     time.Time
+	expires    time.Time
+	staleUntil time.Time
+	refreshing int32
+}
+
+func (self *Server) initPageCache() {
+	self.pageCacheInit.Do(func() {
+		size := self.PageCacheSize
+
+		if size == 0 {
+			size = DefaultPageCacheSize
+		}
+
+		self.pageCache = newLruCache(size)
+	})
+}
+
+// Returns statistics for the rendered page cache.  Stale pages served from the cache are counted as
+// both hits and stale.
+func (self *Server) PageCacheStats() CacheStats {
+	self.initPageCache()
+
+	stats := self.pageCache.Stats()
+	stats.Stale = atomic.LoadInt64(&self.pageCacheStale)
+
+	return stats
+}
+
+// Remove cached pages whose path starts with the given prefix or that have the given tag.  If
+// neither are given, all pages are removed.  Returns the number of pages removed.
+func (self *Server) PurgePages(prefix string, tag string) int {
+	self.initPageCache()
+
+	return self.pageCache.RemoveIf(func(key string, value interface{}) bool {
+		page := value.(*cachedPage)
+
+		switch {
+		case prefix == `` && tag == ``:
+			return true
+		case prefix != `` && strings.HasPrefix(page.path, prefix):
+			return true
+		case tag != `` && sliceutil.ContainsString(page.tags, tag):
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+// Serve the response to the given request from the page cache, if a usable copy is there.  Stale
+// copies are served while the page is rendered again in the background.  Returns whether the
+// response was written.
+func (self *Server) servePageFromCache(w http.ResponseWriter, req *http.Request, policy *PageCacheConfig) bool {
+	self.initPageCache()
+
+	// background refreshes always render the page
+	if req.Context().Value(`diecast-page-refresh`) != nil {
+		return false
+	}
+
+	now := time.Now()
+	value, ok := self.pageCache.GetIf(policy.key(req), func(value interface{}) bool {
+		return now.Before(value.(*cachedPage).staleUntil)
+	})
+
+	if !ok {
+		w.Header().Set(PageCacheHeader, `MISS`)
+		return false
+	}
+
+	page := value.(*cachedPage)
+
+	for name, values := range page.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+
+	if now.Before(page.expires) {
+		w.Header().Set(PageCacheHeader, `HIT`)
+	} else {
+		atomic.AddInt64(&self.pageCacheStale, 1)
+		w.Header().Set(PageCacheHeader, `STALE`)
+		self.revalidatePage(req, page, policy)
+	}
+
+	w.Header().Set(`Age`, fmt.Sprintf("%d", int(now.Sub(page.stored).Seconds())))
+	w.WriteHeader(page.status)
+
+	if req.Method != http.MethodHead {
+		body := page.body
+
+		// pages are stored with the nonce they were rendered with; replace it with this request's
+		if nonce := cspNonce(req); page.nonce != `` && nonce != `` {
+			body = bytes.Replace(body, []byte(page.nonce), []byte(nonce), -1)
+		}
+
+		w.Write(body)
+	}
+
+	return true
+}
+
+// Render the given page again in the background (once at a time), replacing the stale copy.  The
+// page is rendered by the routes directly, since the refresh isn't a request from a client and
+// shouldn't be logged, counted, or rate limited like one.
+func (self *Server) revalidatePage(req *http.Request, page *cachedPage, policy *PageCacheConfig) {
+	if self.mux == nil || !atomic.CompareAndSwapInt32(&page.refreshing, 0, 1) {
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), `diecast-page-refresh`, true)
+
+	// the refreshed page is stored with a nonce that is replaced in each response (see addSecurityHeaders)
+	if self.SecurityHeaders.ContentSecurityPolicy != `` {
+		if nonce, err := newCspNonce(); err == nil {
+			ctx = context.WithValue(ctx, `diecast-csp-nonce`, nonce)
+		}
+	}
+
+	refresh := req.Clone(ctx)
+	refresh.Body = http.NoBody
+
+	// the page is shared by everyone whose requests have the same cache key, so credentials that
+	// aren't part of the key are not passed along
+	for _, name := range []string{`Authorization`, `Proxy-Authorization`} {
+		if !sliceutil.ContainsString(canonicalHeaders(policy.Headers), name) {
+			refresh.Header.Del(name)
+		}
+	}
+
+	refresh.Header.Del(`Cookie`)
+
+	for _, name := range policy.Cookies {
+		if cookie, err := req.Cookie(name); err == nil {
+			refresh.AddCookie(cookie)
+		}
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&page.refreshing, 0)
+		self.mux.ServeHTTP(newDiscardResponseWriter(), refresh)
+	}()
+}
+
+func canonicalHeaders(names []string) []string {
+	canonical := make([]string, len(names))
+
+	for i, name := range names {
+		canonical[i] = http.CanonicalHeaderKey(name)
+	}
+
+	return canonical
+}
+
+// A ResponseWriter for background renders whose output is only needed by the page cache.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{
+		header: make(http.Header),
+	}
+}
+
+func (self *discardResponseWriter) Header() http.Header {
+	return self.header
+}
+
+func (self *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (self *discardResponseWriter) WriteHeader(int) {}
+
+// Store the page rendered into the given writer, if it used a cache policy and can be cached.
+func (self *Server) storePage(req *http.Request, writer *pageCacheWriter) {
+	policy := writer.policy
+
+	if policy == nil || writer.status != http.StatusOK {
+		return
+	} else if req.Method != http.MethodGet || writer.Header().Get(`Set-Cookie`) != `` {
+		return
+	}
+
+	ttl := policy.ttl()
+
+	if ttl <= 0 {
+		return
+	}
+
+	self.initPageCache()
+
+	now := time.Now()
+	header := writer.Header().Clone()
+	header.Del(PageCacheHeader)
+
+	// the page is stored as rendered; compression is applied to each response separately
+	header.Del(`Content-Encoding`)
+	header.Del(`Content-Length`)
+
+	// each response gets the ID of the request it is answering
+	header.Del(RequestIdHeader)
+
+	// each response gets its own Content-Security-Policy nonce (see addSecurityHeaders)
+	header.Del(`Content-Security-Policy`)
+
+	// CORS headers depend on each request's origin
+	for name := range header {
+		if strings.HasPrefix(name, `Access-Control-`) {
+			header.Del(name)
+		}
+	}
+
+	self.pageCache.Set(policy.key(req), &cachedPage{
+		path:       req.URL.Path,
+		tags:       writer.tags,
+		status:     writer.status,
+		header:     header,
+		body:       append([]byte(nil), writer.buffer.Bytes()...),
+		nonce:      cspNonce(req),
+		stored:     now,
+		expires:    now.Add(ttl),
+		staleUntil: now.Add(ttl + policy.staleWhileRevalidate()),
+	})
+}
+
+// Passes a rendered page through to the response while keeping a copy of it, so that pages with a
+// cache policy can be stored once they have been rendered successfully.
+type pageCacheWriter struct {
+	http.ResponseWriter
+	policy *PageCacheConfig
+	tags   []string
+	status int
+	buffer bytes.Buffer
+}
+
+func (self *pageCacheWriter) WriteHeader(status int) {
+	if self.status == 0 {
+		self.status = status
+	}
+
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *pageCacheWriter) Write(p []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+
+	if self.policy != nil {
+		self.buffer.Write(p)
+	}
+
+	return self.ResponseWriter.Write(p)
+}
+
+func (self *pageCacheWriter) Flush() {
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -2,6 +2,7 @@ package diecast
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
@@ -9,31 +10,53 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ghetzel/go-stockutil/httputil"
 	"github.com/ghetzel/go-stockutil/log"
 	"github.com/ghetzel/go-stockutil/sliceutil"
 	"github.com/ghetzel/go-stockutil/typeutil"
+	"github.com/gobwas/glob"
 )
 
 var DefaultProxyMountTimeout = time.Duration(10) * time.Second
 var MaxBufferedBodySize = 16535
 
 type ProxyMount struct {
-	MountPoint          string                 `json:"-"`
-	URL                 string                 `json:"-"`
-	Method              string                 `json:"method,omitempty"`
-	Headers             map[string]interface{} `json:"headers,omitempty"`
-	Params              map[string]interface{} `json:"params,omitempty"`
-	Timeout             time.Duration          `json:"timeout,omitempty"`
-	PassthroughRequests bool                   `json:"passthrough_requests"`
-	PassthroughErrors   bool                   `json:"passthrough_errors"`
-	StripPathPrefix     string                 `json:"strip_path_prefix"`
-	Insecure            bool                   `json:"insecure"`
-	Client              *http.Client
-	urlRewriteFrom      string
-	urlRewriteTo        string
+	MountPoint           string                 `json:"-"`
+	URL                  string                 `json:"-"`
+	Method               string                 `json:"method,omitempty"`
+	Headers              map[string]interface{} `json:"headers,omitempty"`
+	Params               map[string]interface{} `json:"params,omitempty"`
+	Timeout              time.Duration          `json:"timeout,omitempty"`
+	PassthroughRequests  bool                   `json:"passthrough_requests"`
+	PassthroughErrors    bool                   `json:"passthrough_errors"`
+	StripPathPrefix      string                 `json:"strip_path_prefix"`
+	Insecure             bool                   `json:"insecure"`
+	Upstreams            []string               `json:"upstreams,omitempty"`
+	Balance              string                 `json:"balance,omitempty"`
+	HealthCheck          ProxyHealthCheck       `json:"health_check,omitempty"`
+	RewriteRedirects     bool                   `json:"rewrite_redirects"`
+	RewriteCookies       bool                   `json:"rewrite_cookies"`
+	CookieDomain         string                 `json:"cookie_domain,omitempty"`
+	RewriteHTML          bool                   `json:"rewrite_html"`
+	AllowResponseHeaders []string               `json:"allow_response_headers,omitempty"`
+	DenyResponseHeaders  []string               `json:"deny_response_headers,omitempty"`
+	Client               *http.Client
+	urlRewriteFrom       string
+	urlRewriteTo         string
+	headerFiltersInit    sync.Once
+	allowHeaders         []glob.Glob
+	denyHeaders          []glob.Glob
+	upstreams            []*proxyUpstream
+	upstreamsInit        sync.Once
+	upstreamCounter      uint64
+	balance              BalanceMethod
+	healthCheckStop      chan struct{}
+	closed               bool
+	closeLock            sync.Mutex
+	MountMatcher
 }
 
 func (self *ProxyMount) GetMountPoint() string {
@@ -41,44 +64,136 @@ func (self *ProxyMount) GetMountPoint() string {
 }
 
 func (self *ProxyMount) WillRespondTo(name string, req *http.Request, requestBody io.Reader) bool {
-	return strings.HasPrefix(name, self.GetMountPoint())
+	return self.matches(self.GetMountPoint(), name, req)
 }
 
 func (self *ProxyMount) OpenWithType(name string, req *http.Request, requestBody io.Reader) (*MountResponse, error) {
-	var proxyURI string
+	self.initClient()
 
-	if self.Client == nil {
-		if self.Timeout == 0 {
-			self.Timeout = DefaultProxyMountTimeout
+	if self.Method == `` {
+		self.Method = `get`
+	}
+
+	tried := make([]*proxyUpstream, 0)
+
+	for {
+		upstream := self.nextUpstream(tried...)
+
+		if upstream == nil {
+			return nil, fmt.Errorf("%v: no upstreams available", self)
 		}
 
-		self.Client = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: self.Insecure,
-				},
-			},
-			Timeout: self.Timeout,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				if self.urlRewriteTo == `` {
-					if len(via) > 0 {
-						self.urlRewriteFrom = via[len(via)-1].URL.String()
-						self.urlRewriteFrom = strings.TrimSuffix(self.urlRewriteFrom, `/`)
-						self.urlRewriteTo = req.URL.String()
+		tried = append(tried, upstream)
+
+		newReq, err := self.newProxyRequest(upstream.URL, name, req, requestBody)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if req != nil {
+			log.Infof("  proxying '%v %v' to '%v %v'", req.Method, req.URL, newReq.Method, newReq.URL)
+		}
+
+		log.Debugf("  %v %v", newReq.Method, newReq.URL)
+
+		for k, v := range newReq.Header {
+			log.Debugf("  [H] %v: %v", k, strings.Join(v, ` `))
+		}
+
+		upstream.begin()
+		started := time.Now()
+
+		if response, done, err := self.send(newReq, req); err == nil {
+			if metrics := requestMetrics(req); metrics != nil {
+				metrics.upstreamDuration.Observe(time.Since(started), self.GetMountPoint(), newReq.URL.Host)
+			}
+
+			// event streams are passed on to the client as they are received
+			if self.PassthroughRequests && response.StatusCode < 400 && isEventStream(response.Header.Get(`Content-Type`)) {
+				upstream.succeeded()
+
+				return self.streamResponse(name, response, func() {
+					done()
+					upstream.end()
+				}), nil
+			}
+
+			mountResponse, err := self.handleResponse(name, newReq, response)
+			done()
+			upstream.end()
+
+			if response.StatusCode >= 500 {
+				upstream.failed(fmt.Errorf("upstream returned %v", response.Status), self.maxFails(), self.failTimeout())
+			} else {
+				upstream.succeeded()
+			}
+
+			return mountResponse, err
+		} else {
+			if metrics := requestMetrics(req); metrics != nil {
+				metrics.upstreamErrors.Add(1, self.GetMountPoint(), newReq.URL.Host)
+			}
+
+			upstream.end()
+			upstream.failed(err, self.maxFails(), self.failTimeout())
+
+			// try the request against another upstream, provided there are any left and we can
+			// rewind the request body
+			if len(tried) < len(self.upstreams) {
+				if requestBody == nil || !self.PassthroughRequests {
+					continue
+				} else if seeker, ok := requestBody.(io.Seeker); ok {
+					if _, serr := seeker.Seek(0, io.SeekStart); serr == nil {
+						log.Warningf("  upstream %v failed, retrying: %v", upstream.URL, err)
+						continue
 					}
 				}
+			}
 
-				return nil
-			},
+			return nil, err
 		}
 	}
+}
+
+// Send the given request to an upstream.  Passthrough requests may turn out to be long-lived event
+// streams, so rather than the client's overall timeout (which would cut streams off), the timeout
+// applies until the response has been read (or for event streams, until its headers have arrived).
+// The returned function must be called once the response body is no longer needed.
+func (self *ProxyMount) send(newReq *http.Request, req *http.Request) (*http.Response, func(), error) {
+	if !self.PassthroughRequests || req == nil || self.Client.Timeout <= 0 {
+		response, err := self.Client.Do(newReq)
+		return response, func() {}, err
+	}
 
-	if self.Method == `` {
-		self.Method = `get`
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(self.Client.Timeout, cancel)
+	client := *self.Client
+	client.Timeout = 0
+
+	done := func() {
+		timer.Stop()
+		cancel()
+	}
+
+	response, err := client.Do(newReq.WithContext(ctx))
+
+	if err != nil {
+		done()
+		return nil, nil, err
+	} else if isEventStream(response.Header.Get(`Content-Type`)) {
+		timer.Stop()
 	}
 
+	return response, done, nil
+}
+
+// Build the request that will be sent to the given upstream on behalf of the incoming request.
+func (self *ProxyMount) newProxyRequest(baseURL string, name string, req *http.Request, requestBody io.Reader) (*http.Request, error) {
+	var proxyURI string
+
 	if req != nil && self.PassthroughRequests {
-		if newURL, err := url.Parse(self.url()); err == nil {
+		if newURL, err := url.Parse(self.urlFor(baseURL)); err == nil {
 			req.URL.Scheme = newURL.Scheme
 			req.URL.Host = newURL.Host
 
@@ -107,7 +222,7 @@ func (self *ProxyMount) OpenWithType(name string, req *http.Request, requestBody
 		}
 	} else {
 		proxyURI = strings.Join([]string{
-			strings.TrimSuffix(self.url(), `/`),
+			strings.TrimSuffix(self.urlFor(baseURL), `/`),
 			strings.TrimPrefix(name, `/`),
 		}, `/`)
 	}
@@ -136,6 +251,12 @@ func (self *ProxyMount) OpenWithType(name string, req *http.Request, requestBody
 			newReq.Header.Set(name, typeutil.String(value))
 		}
 
+		if req != nil {
+			if id := reqid(req); id != `` {
+				newReq.Header.Set(RequestIdHeader, id)
+			}
+		}
+
 		// inject params into new request
 		for name, value := range self.Params {
 			if newReq.URL.Query().Get(name) == `` {
@@ -166,76 +287,125 @@ func (self *ProxyMount) OpenWithType(name string, req *http.Request, requestBody
 			}
 		}
 
-		log.Infof("  proxying '%v %v' to '%v %v'", req.Method, req.URL, newReq.Method, newReq.URL)
-		log.Debugf("  %v %v", newReq.Method, newReq.URL)
+		return newReq, nil
+	} else {
+		return nil, err
+	}
+}
 
-		for k, v := range newReq.Header {
-			log.Debugf("  [H] %v: %v", k, strings.Join(v, ` `))
-		}
+// Convert an upstream response into a MountResponse.
+func (self *ProxyMount) handleResponse(name string, newReq *http.Request, response *http.Response) (*MountResponse, error) {
+	if response.Body != nil {
+		defer response.Body.Close()
+	}
 
-		if response, err := self.Client.Do(newReq); err == nil {
-			if response.Body != nil {
-				defer response.Body.Close()
-			}
+	log.Debugf("  [R] %v", response.Status)
 
-			log.Debugf("  [R] %v", response.Status)
+	for k, v := range response.Header {
+		log.Debugf("  [R]   %v: %v", k, strings.Join(v, ` `))
+	}
 
-			for k, v := range response.Header {
-				log.Debugf("  [R]   %v: %v", k, strings.Join(v, ` `))
-			}
+	log.Infof(
+		"%v %v responded with: %v (Content-Length: %v)",
+		newReq.Method,
+		newReq.URL,
+		response.Status,
+		response.ContentLength,
+	)
 
-			log.Infof(
-				"%v %v responded with: %v (Content-Length: %v)",
-				newReq.Method,
-				newReq.URL,
-				response.Status,
-				response.ContentLength,
-			)
-
-			if response.StatusCode < 400 || self.PassthroughErrors {
-				var responseBody io.Reader
-
-				if body, err := httputil.DecodeResponse(response); err == nil {
-					responseBody = body
-					response.Header.Set(`Content-Encoding`, `identity`)
-				} else {
-					return nil, err
-				}
+	if response.StatusCode < 400 || self.PassthroughErrors {
+		var responseBody io.Reader
 
-				if data, err := ioutil.ReadAll(responseBody); err == nil {
-					payload := bytes.NewReader(data)
-					mountResponse := NewMountResponse(name, payload.Size(), payload)
-					mountResponse.StatusCode = response.StatusCode
-					mountResponse.ContentType = response.Header.Get(`Content-Type`)
+		if body, err := httputil.DecodeResponse(response); err == nil {
+			responseBody = body
+			response.Header.Set(`Content-Encoding`, `identity`)
+		} else {
+			return nil, err
+		}
 
-					for k, v := range response.Header {
-						mountResponse.Metadata[k] = strings.Join(v, `,`)
-					}
+		if data, err := ioutil.ReadAll(responseBody); err == nil {
+			self.rewriteResponseHeaders(response.Header)
 
-					return mountResponse, nil
-				} else {
-					return nil, err
-				}
-			} else {
-				// if data, err := ioutil.ReadAll(response.Body); err == nil {
-				// 	for _, line := range stringutil.SplitLines(data, "\n") {
-				// 		log.Debugf("  [B] %s", line)
-				// 	}
-				// }
-				// log.Debugf("  %s %s: %s", method, newReq.URL, response.Status)
-				return nil, MountHaltErr
+			if self.RewriteHTML && strings.Contains(response.Header.Get(`Content-Type`), `html`) {
+				data = self.rewriteHTML(data)
+			}
+
+			payload := bytes.NewReader(data)
+			mountResponse := NewMountResponse(name, payload.Size(), payload)
+			mountResponse.StatusCode = response.StatusCode
+			mountResponse.ContentType = response.Header.Get(`Content-Type`)
+
+			if lm, err := http.ParseTime(response.Header.Get(`Last-Modified`)); err == nil {
+				mountResponse.modTime = lm
 			}
+
+			// the body has already been decoded (and possibly rewritten), so the upstream length no
+			// longer applies
+			response.Header.Del(`Content-Length`)
+			self.setResponseMetadata(mountResponse, response.Header)
+
+			return mountResponse, nil
 		} else {
 			return nil, err
 		}
 	} else {
-		return nil, err
+		return nil, MountHaltErr
+	}
+}
+
+// Copy the upstream response headers that are allowed through into the mount response.
+func (self *ProxyMount) setResponseMetadata(mountResponse *MountResponse, header http.Header) {
+	for k, v := range header {
+		if !self.isResponseHeaderAllowed(k) {
+			continue
+		}
+
+		if k == `Set-Cookie` {
+			mountResponse.Metadata[k] = v
+		} else {
+			mountResponse.Metadata[k] = strings.Join(v, `,`)
+		}
+	}
+}
+
+func (self *ProxyMount) initClient() {
+	if self.Client == nil {
+		if self.Timeout == 0 {
+			self.Timeout = DefaultProxyMountTimeout
+		}
+
+		self.Client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: self.Insecure,
+				},
+			},
+			Timeout: self.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				// let the client follow the (rewritten) redirect itself
+				if self.RewriteRedirects {
+					return http.ErrUseLastResponse
+				}
+
+				if self.urlRewriteTo == `` {
+					if len(via) > 0 {
+						self.urlRewriteFrom = via[len(via)-1].URL.String()
+						self.urlRewriteFrom = strings.TrimSuffix(self.urlRewriteFrom, `/`)
+						self.urlRewriteTo = req.URL.String()
+					}
+				}
+
+				return nil
+			},
+		}
 	}
 }
 
 func (self *ProxyMount) url() string {
-	uri := self.URL
+	return self.urlFor(self.URL)
+}
 
+func (self *ProxyMount) urlFor(uri string) string {
 	if from := self.urlRewriteFrom; from != `` {
 		if to := self.urlRewriteTo; to != `` {
 			uri = strings.Replace(uri, from, to, 1)
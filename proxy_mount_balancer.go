@@ -0,0 +1,466 @@
+package diecast
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/ghetzel/go-stockutil/sliceutil"
+	"github.com/ghetzel/go-stockutil/timeutil"
+)
+
+type BalanceMethod string
+
+const (
+	BalanceRoundRobin BalanceMethod = `round-robin`
+	BalanceLeastConns BalanceMethod = `least-conn`
+)
+
+var DefaultHealthCheckInterval = time.Duration(10) * time.Second
+var DefaultHealthCheckTimeout = time.Duration(2) * time.Second
+var DefaultUpstreamMaxFails = 3
+var DefaultUpstreamFailTimeout = time.Duration(30) * time.Second
+
+// Configures how the upstreams of a ProxyMount are checked for health.
+type ProxyHealthCheck struct {
+	// The path (relative to each upstream URL) to request when performing active health checks.
+	// If empty, active health checks are disabled.
+	Path string `json:"path,omitempty"`
+
+	// The HTTP method used to perform the health check.
+	Method string `json:"method,omitempty"`
+
+	// How often active health checks are performed.
+	Interval string `json:"interval,omitempty"`
+
+	// How long to wait for an upstream to respond to a health check.
+	Timeout string `json:"timeout,omitempty"`
+
+	// A list of HTTP status codes that indicate a healthy upstream.  If empty, any 2xx or 3xx
+	// status is considered healthy.
+	ExpectStatus []int `json:"expect_status,omitempty"`
+
+	// The number of consecutive failed requests that will take an upstream out of rotation.  A single
+	// failed active health check always does, and the upstream stays out of rotation until a
+	// subsequent check passes.
+	MaxFails int `json:"max_fails,omitempty"`
+
+	// How long an upstream that was marked down due to passive failures stays out of rotation
+	// before being tried again.
+	FailTimeout string `json:"fail_timeout,omitempty"`
+}
+
+// The state of a single upstream in a load-balanced ProxyMount.
+type ProxyUpstream struct {
+	URL         string    `json:"url"`
+	Healthy     bool      `json:"healthy"`
+	Active      int64     `json:"active"`
+	Requests    int64     `json:"requests"`
+	Failures    int64     `json:"failures"`
+	Consecutive int       `json:"consecutive_failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastChecked time.Time `json:"last_checked,omitempty"`
+	DownUntil   time.Time `json:"down_until,omitempty"`
+}
+
+type proxyUpstream struct {
+	ProxyUpstream
+	lock     sync.Mutex
+	checkErr error
+}
+
+func (self *proxyUpstream) isAvailable() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.checkErr != nil {
+		return false
+	} else if self.Healthy {
+		return true
+	} else if !self.DownUntil.IsZero() && time.Now().After(self.DownUntil) {
+		// passively-failed upstreams get another chance once their fail timeout has elapsed
+		return true
+	}
+
+	return false
+}
+
+func (self *proxyUpstream) begin() {
+	atomic.AddInt64(&self.Active, 1)
+	atomic.AddInt64(&self.Requests, 1)
+}
+
+func (self *proxyUpstream) end() {
+	atomic.AddInt64(&self.Active, -1)
+}
+
+func (self *proxyUpstream) succeeded() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.Healthy {
+		log.Noticef("upstream %v is back in rotation", self.URL)
+	}
+
+	self.Healthy = true
+	self.Consecutive = 0
+	self.DownUntil = time.Time{}
+}
+
+// Record the result of an active health check.  Failed checks take the upstream out of rotation
+// immediately, and it stays out until a check passes.
+func (self *proxyUpstream) checked(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.LastChecked = time.Now()
+
+	if err == nil {
+		if !self.Healthy {
+			log.Noticef("upstream %v is back in rotation", self.URL)
+		}
+
+		self.Healthy = true
+		self.Consecutive = 0
+		self.DownUntil = time.Time{}
+	} else {
+		if self.Healthy {
+			log.Warningf("upstream %v taken out of rotation after a failed health check: %v", self.URL, err)
+		}
+
+		self.Failures += 1
+		self.LastError = err.Error()
+		self.Healthy = false
+		self.DownUntil = time.Time{}
+	}
+
+	self.checkErr = err
+}
+
+// Returns the result of the last active health check, and whether there has been one.
+func (self *proxyUpstream) lastCheck() (error, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.checkErr, !self.LastChecked.IsZero()
+}
+
+func (self *proxyUpstream) failed(err error, maxFails int, failTimeout time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.Failures += 1
+	self.Consecutive += 1
+
+	if err != nil {
+		self.LastError = err.Error()
+	}
+
+	// upstreams that failed a health check are already out of rotation until one passes
+	if self.Consecutive >= maxFails && self.checkErr == nil {
+		if self.Healthy {
+			log.Warningf("upstream %v taken out of rotation after %d failures: %v", self.URL, self.Consecutive, err)
+		}
+
+		self.Healthy = false
+		self.DownUntil = time.Now().Add(failTimeout)
+	}
+}
+
+// Returns a copy of the upstream's current state that is safe to serialize.
+func (self *proxyUpstream) Status() ProxyUpstream {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return ProxyUpstream{
+		URL:         self.URL,
+		Healthy:     self.Healthy,
+		Active:      atomic.LoadInt64(&self.Active),
+		Requests:    atomic.LoadInt64(&self.Requests),
+		Failures:    self.Failures,
+		Consecutive: self.Consecutive,
+		LastError:   self.LastError,
+		LastChecked: self.LastChecked,
+		DownUntil:   self.DownUntil,
+	}
+}
+
+// Returns the current state of all upstreams this mount balances requests across.
+func (self *ProxyMount) UpstreamStatus() []ProxyUpstream {
+	self.initUpstreams()
+
+	statuses := make([]ProxyUpstream, len(self.upstreams))
+
+	for i, upstream := range self.upstreams {
+		statuses[i] = upstream.Status()
+	}
+
+	return statuses
+}
+
+func (self *ProxyMount) initUpstreams() {
+	self.upstreamsInit.Do(func() {
+		urls := sliceutil.CompactString(
+			sliceutil.UniqueStrings(append([]string{self.URL}, self.Upstreams...)),
+		)
+
+		for _, u := range urls {
+			self.upstreams = append(self.upstreams, &proxyUpstream{
+				ProxyUpstream: ProxyUpstream{
+					URL:     u,
+					Healthy: true,
+				},
+			})
+		}
+
+		switch method := BalanceMethod(strings.ToLower(self.Balance)); method {
+		case BalanceRoundRobin, BalanceLeastConns:
+			self.balance = method
+		case ``:
+			self.balance = BalanceRoundRobin
+		default:
+			log.Warningf("%v: unknown balancing method %q, using %v", self, self.Balance, BalanceRoundRobin)
+			self.balance = BalanceRoundRobin
+		}
+	})
+}
+
+// Begin performing active health checks against the upstreams (if a health check path is
+// configured.)  Called when the server is initialized, or when a configuration reload adds the mount.
+func (self *ProxyMount) Start() error {
+	self.initClient()
+	self.initUpstreams()
+
+	self.closeLock.Lock()
+	defer self.closeLock.Unlock()
+
+	if self.HealthCheck.Path != `` && self.healthCheckStop == nil && !self.closed {
+		self.healthCheckStop = make(chan struct{})
+		go self.runHealthChecks(self.healthCheckStop)
+	}
+
+	return nil
+}
+
+// Returns whether active health checks are being performed.
+func (self *ProxyMount) checking() bool {
+	self.closeLock.Lock()
+	defer self.closeLock.Unlock()
+
+	return self.healthCheckStop != nil && !self.closed
+}
+
+// Stop performing health checks.  Called when the mount is removed by a configuration reload, or
+// the server shuts down.
+func (self *ProxyMount) Close() error {
+	self.closeLock.Lock()
+	defer self.closeLock.Unlock()
+
+	if !self.closed {
+		self.closed = true
+
+		if self.healthCheckStop != nil {
+			close(self.healthCheckStop)
+		}
+	}
+
+	return nil
+}
+
+// Select the next upstream to send a request to according to the mount's balancing method.
+// Upstreams that are out of rotation are skipped unless no upstreams are available at all, in
+// which case those that were taken out by passive failures are tried anyway.
+func (self *ProxyMount) nextUpstream(exclude ...*proxyUpstream) *proxyUpstream {
+	self.initUpstreams()
+
+	candidates := make([]*proxyUpstream, 0, len(self.upstreams))
+
+UpstreamLoop:
+	for _, upstream := range self.upstreams {
+		for _, x := range exclude {
+			if x == upstream {
+				continue UpstreamLoop
+			}
+		}
+
+		if upstream.isAvailable() {
+			candidates = append(candidates, upstream)
+		}
+	}
+
+	if len(candidates) == 0 {
+		if len(exclude) > 0 || len(self.upstreams) == 0 {
+			return nil
+		}
+
+		for _, upstream := range self.upstreams {
+			if err, _ := upstream.lastCheck(); err == nil {
+				candidates = append(candidates, upstream)
+			}
+		}
+
+		if len(candidates) == 0 {
+			return nil
+		}
+	}
+
+	if self.balance == BalanceLeastConns {
+		var best *proxyUpstream
+
+		for _, upstream := range candidates {
+			if best == nil || atomic.LoadInt64(&upstream.Active) < atomic.LoadInt64(&best.Active) {
+				best = upstream
+			}
+		}
+
+		return best
+	}
+
+	n := atomic.AddUint64(&self.upstreamCounter, 1)
+	return candidates[int((n-1)%uint64(len(candidates)))]
+}
+
+func (self *ProxyMount) maxFails() int {
+	if self.HealthCheck.MaxFails > 0 {
+		return self.HealthCheck.MaxFails
+	} else {
+		return DefaultUpstreamMaxFails
+	}
+}
+
+func (self *ProxyMount) failTimeout() time.Duration {
+	if d, err := timeutil.ParseDuration(self.HealthCheck.FailTimeout); err == nil && d > 0 {
+		return d
+	} else {
+		return DefaultUpstreamFailTimeout
+	}
+}
+
+func (self *ProxyMount) runHealthChecks(stop <-chan struct{}) {
+	interval := DefaultHealthCheckInterval
+	timeout := DefaultHealthCheckTimeout
+
+	if d, err := timeutil.ParseDuration(self.HealthCheck.Interval); err == nil && d > 0 {
+		interval = d
+	}
+
+	if d, err := timeutil.ParseDuration(self.HealthCheck.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+	}
+
+	if self.Client != nil {
+		client.Transport = self.Client.Transport
+	}
+
+	for {
+		for _, upstream := range self.upstreams {
+			err := self.checkUpstream(client, upstream)
+			upstream.checked(err)
+
+			if err != nil {
+				log.Debugf("health check for %v failed: %v", upstream.URL, err)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Check that at least one upstream is reachable: either its health check passes (if one is
+// configured), or a connection can be made to it.  While active health checks are running, the
+// result of each upstream's most recent check is used.
+func (self *ProxyMount) Probe(timeout time.Duration) error {
+	self.initClient()
+	self.initUpstreams()
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: self.Client.Transport,
+	}
+
+	err := fmt.Errorf("no upstreams configured")
+	checking := self.checking()
+
+	for _, upstream := range self.upstreams {
+		if self.HealthCheck.Path != `` {
+			if lastErr, ok := upstream.lastCheck(); checking && ok {
+				err = lastErr
+			} else {
+				err = self.checkUpstream(client, upstream)
+			}
+		} else {
+			err = dialUpstream(upstream.URL, timeout)
+		}
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func dialUpstream(upstreamURL string, timeout time.Duration) error {
+	u, err := url.Parse(upstreamURL)
+
+	if err != nil {
+		return err
+	}
+
+	address := u.Host
+
+	if u.Port() == `` {
+		if u.Scheme == `https` {
+			address = net.JoinHostPort(u.Hostname(), `443`)
+		} else {
+			address = net.JoinHostPort(u.Hostname(), `80`)
+		}
+	}
+
+	if conn, err := net.DialTimeout(`tcp`, address, timeout); err == nil {
+		return conn.Close()
+	} else {
+		return err
+	}
+}
+
+func (self *ProxyMount) checkUpstream(client *http.Client, upstream *proxyUpstream) error {
+	checkURL := strings.TrimSuffix(upstream.URL, `/`) + `/` + strings.TrimPrefix(self.HealthCheck.Path, `/`)
+	method := strings.ToUpper(sliceutil.OrString(self.HealthCheck.Method, `get`))
+
+	if req, err := http.NewRequest(method, checkURL, nil); err == nil {
+		if response, err := client.Do(req); err == nil {
+			response.Body.Close()
+
+			if len(self.HealthCheck.ExpectStatus) > 0 {
+				for _, code := range self.HealthCheck.ExpectStatus {
+					if response.StatusCode == code {
+						return nil
+					}
+				}
+			} else if response.StatusCode < 400 {
+				return nil
+			}
+
+			return fmt.Errorf("health check returned %v", response.Status)
+		} else {
+			return err
+		}
+	} else {
+		return err
+	}
+}
@@ -0,0 +1,190 @@
+package diecast
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/gobwas/glob"
+)
+
+var rxHtmlUrlAttributes = regexp.MustCompile(`(?i)(\s(?:href|src|action|poster)\s*=\s*)(["'])([^"']*)(["'])`)
+
+// Returns whether the named upstream response header should be passed through to the client.
+func (self *ProxyMount) isResponseHeaderAllowed(name string) bool {
+	name = strings.ToLower(name)
+
+	self.headerFiltersInit.Do(func() {
+		self.allowHeaders = compileHeaderGlobs(self.AllowResponseHeaders)
+		self.denyHeaders = compileHeaderGlobs(self.DenyResponseHeaders)
+	})
+
+	if len(self.AllowResponseHeaders) > 0 {
+		allowed := false
+
+		for _, g := range self.allowHeaders {
+			if g.Match(name) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	for _, g := range self.denyHeaders {
+		if g.Match(name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Converts a path as the upstream sees it into the path a client would request from us.
+func (self *ProxyMount) publicPath(upstreamPath string) string {
+	var base string
+
+	// non-passthrough requests are appended to the path of the upstream URL
+	if !self.PassthroughRequests {
+		if u, err := url.Parse(self.URL); err == nil {
+			base = strings.TrimSuffix(u.Path, `/`)
+		}
+	}
+
+	if base != `` {
+		if upstreamPath != base && !strings.HasPrefix(upstreamPath, base+`/`) {
+			return upstreamPath
+		}
+
+		upstreamPath = strings.TrimPrefix(upstreamPath, base)
+	}
+
+	if prefix := strings.TrimSuffix(self.StripPathPrefix, `/`); prefix != `` {
+		// already pointing at the public location
+		if upstreamPath == prefix || strings.HasPrefix(upstreamPath, prefix+`/`) {
+			return upstreamPath
+		}
+
+		return prefix + `/` + strings.TrimPrefix(upstreamPath, `/`)
+	}
+
+	return upstreamPath
+}
+
+// Rewrites a URL that points at one of this mount's upstreams so that it points at the mount
+// instead.  URLs pointing elsewhere are returned unmodified.
+func (self *ProxyMount) rewriteURL(in string) string {
+	if in == `` || strings.HasPrefix(in, `#`) {
+		return in
+	}
+
+	if u, err := url.Parse(in); err == nil {
+		if u.Host != `` {
+			if !self.isUpstreamHost(u.Host) {
+				return in
+			}
+
+			u.Scheme = ``
+			u.Host = ``
+			u.User = nil
+		} else if u.Scheme != `` || !strings.HasPrefix(u.Path, `/`) {
+			// things like "mailto:" and relative paths don't need rewriting
+			return in
+		}
+
+		u.Path = self.publicPath(u.Path)
+
+		if u.Path == `` {
+			u.Path = `/`
+		}
+
+		return u.String()
+	}
+
+	return in
+}
+
+func (self *ProxyMount) isUpstreamHost(host string) bool {
+	self.initUpstreams()
+
+	for _, upstream := range self.upstreams {
+		if u, err := url.Parse(upstream.URL); err == nil && strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply all configured outbound rewriting rules to the given upstream response headers.
+func (self *ProxyMount) rewriteResponseHeaders(header http.Header) {
+	if self.RewriteRedirects {
+		for _, name := range []string{`Location`, `Content-Location`} {
+			if v := header.Get(name); v != `` {
+				header.Set(name, self.rewriteURL(v))
+			}
+		}
+	}
+
+	if self.RewriteCookies || self.CookieDomain != `` {
+		cookies := (&http.Response{
+			Header: header,
+		}).Cookies()
+
+		header.Del(`Set-Cookie`)
+
+		for _, cookie := range cookies {
+			if self.CookieDomain != `` {
+				cookie.Domain = self.CookieDomain
+			} else {
+				cookie.Domain = ``
+			}
+
+			if self.RewriteCookies && cookie.Path != `` {
+				cookie.Path = self.publicPath(cookie.Path)
+			}
+
+			header.Add(`Set-Cookie`, cookie.String())
+		}
+	}
+}
+
+// Rewrites href, src, action, and poster attributes in the given HTML document so that links to
+// the upstream point at the mount instead.
+func (self *ProxyMount) rewriteHTML(body []byte) []byte {
+	return rxHtmlUrlAttributes.ReplaceAllFunc(body, func(match []byte) []byte {
+		parts := rxHtmlUrlAttributes.FindSubmatch(match)
+
+		return []byte(
+			string(parts[1]) + string(parts[2]) + self.rewriteURL(string(parts[3])) + string(parts[4]),
+		)
+	})
+}
+
+func headerGlobMatch(pattern string, name string) bool {
+	if g, err := glob.Compile(strings.ToLower(pattern)); err == nil {
+		return g.Match(name)
+	}
+
+	return false
+}
+
+// Compile the given (case-insensitive) hostname or header name patterns, logging any that are invalid.
+func compileHeaderGlobs(patterns []string) []glob.Glob {
+	globs := make([]glob.Glob, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		if g, err := glob.Compile(strings.ToLower(pattern)); err == nil {
+			globs = append(globs, g)
+		} else {
+			log.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	return globs
+}
@@ -0,0 +1,229 @@
+package diecast
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ghetzel/go-stockutil/log"
+)
+
+// Returns whether the given request should be streamed directly to and from an upstream rather than
+// being buffered into a MountResponse.  This is the case for WebSocket upgrades; Server-Sent Events are
+// recognized by the upstream's response instead (see streamResponse).
+func (self *ProxyMount) WillStream(req *http.Request) bool {
+	if req == nil || !self.PassthroughRequests {
+		return false
+	}
+
+	return isWebsocketUpgrade(req)
+}
+
+// Proxy the given WebSocket upgrade to an upstream, hijacking the client connection and copying data
+// bidirectionally until either side closes.
+func (self *ProxyMount) ServeStream(w http.ResponseWriter, req *http.Request, requestPath string) error {
+	upstream := self.nextUpstream()
+
+	if upstream == nil {
+		return fmt.Errorf("%v: no upstreams available", self)
+	}
+
+	self.initClient()
+
+	var newReq *http.Request
+	var err error
+
+	upstream.begin()
+	defer upstream.end()
+
+	if newReq, err = self.newProxyRequest(upstream.URL, requestPath, req, nil); err == nil {
+		err = self.proxyWebsocket(w, newReq)
+	}
+
+	if err == nil {
+		upstream.succeeded()
+	} else {
+		upstream.failed(err, self.maxFails(), self.failTimeout())
+	}
+
+	return err
+}
+
+func (self *ProxyMount) proxyWebsocket(w http.ResponseWriter, newReq *http.Request) error {
+	hijacker, ok := w.(http.Hijacker)
+
+	if !ok {
+		return fmt.Errorf("response does not support connection hijacking")
+	}
+
+	// the upgrade handshake headers are hop-by-hop, so they need to be explicitly restored
+	newReq.Header.Set(`Connection`, `Upgrade`)
+	newReq.Header.Set(`Upgrade`, `websocket`)
+
+	upstreamConn, err := self.dialUpstream(newReq)
+
+	if err != nil {
+		return err
+	}
+
+	defer upstreamConn.Close()
+
+	log.Infof("  proxying websocket to %v", newReq.URL)
+
+	if err := newReq.Write(upstreamConn); err != nil {
+		return err
+	}
+
+	upstreamReader := bufio.NewReader(upstreamConn)
+	response, err := http.ReadResponse(upstreamReader, newReq)
+
+	if err != nil {
+		return err
+	}
+
+	// upstream declined the upgrade; relay its response as-is
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		defer response.Body.Close()
+
+		for k, v := range response.Header {
+			w.Header()[k] = v
+		}
+
+		w.WriteHeader(response.StatusCode)
+		_, err := io.Copy(w, response.Body)
+		return err
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+
+	if err != nil {
+		return err
+	}
+
+	defer clientConn.Close()
+
+	if err := response.Write(clientConn); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	// upstream -> client (including anything the upstream sent immediately after the handshake)
+	go func() {
+		defer wg.Done()
+		io.Copy(clientConn, upstreamReader)
+		closeWrite(clientConn)
+	}()
+
+	// client -> upstream (including anything the client sent that was already buffered)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstreamConn, clientBuf)
+		closeWrite(upstreamConn)
+	}()
+
+	wg.Wait()
+	log.Debugf("  websocket to %v closed", newReq.URL)
+
+	return nil
+}
+
+// Convert an upstream response that is an event stream into a MountResponse whose payload is the
+// response body itself, so that events are passed on to the client as they are received.  The given
+// function is called once the stream has been closed.
+func (self *ProxyMount) streamResponse(name string, response *http.Response, done func()) *MountResponse {
+	self.rewriteResponseHeaders(response.Header)
+	response.Header.Del(`Content-Length`)
+
+	mountResponse := NewMountResponse(name, -1, &streamBody{
+		ReadCloser: response.Body,
+		done:       done,
+	})
+
+	mountResponse.streaming = true
+	mountResponse.StatusCode = response.StatusCode
+	mountResponse.ContentType = response.Header.Get(`Content-Type`)
+	self.setResponseMetadata(mountResponse, response.Header)
+
+	return mountResponse
+}
+
+type streamBody struct {
+	io.ReadCloser
+	done      func()
+	closeOnce sync.Once
+}
+
+func (self *streamBody) Close() error {
+	var err error
+
+	self.closeOnce.Do(func() {
+		err = self.ReadCloser.Close()
+
+		if self.done != nil {
+			self.done()
+		}
+	})
+
+	return err
+}
+
+func (self *ProxyMount) dialUpstream(req *http.Request) (net.Conn, error) {
+	host := req.URL.Host
+	dialer := &net.Dialer{
+		Timeout: self.Timeout,
+	}
+
+	switch req.URL.Scheme {
+	case `https`, `wss`:
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, `443`)
+		}
+
+		return tls.DialWithDialer(dialer, `tcp`, host, &tls.Config{
+			InsecureSkipVerify: self.Insecure,
+			ServerName:         req.URL.Hostname(),
+		})
+	default:
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, `80`)
+		}
+
+		return dialer.Dial(`tcp`, host)
+	}
+}
+
+func isWebsocketUpgrade(req *http.Request) bool {
+	if strings.ToLower(req.Header.Get(`Upgrade`)) != `websocket` {
+		return false
+	}
+
+	for _, value := range strings.Split(req.Header.Get(`Connection`), `,`) {
+		if strings.ToLower(strings.TrimSpace(value)) == `upgrade` {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isEventStream(mediaTypes string) bool {
+	return strings.Contains(strings.ToLower(mediaTypes), `text/event-stream`)
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,257 @@
+package diecast
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/timeutil"
+)
+
+// The paths (beneath the route prefix) of the liveness and readiness endpoints.  Unlike the
+// introspection endpoints, these are always available; they only report which checks were performed
+// and why any failed (with credentials removed from error messages).
+var HealthPath = `/_diecast/health`
+var ReadyPath = `/_diecast/ready`
+
+// How long each mount may take to respond to a readiness probe.
+var DefaultProbeTimeout = 2 * time.Second
+
+// How long readiness probes reuse the result of evaluating the global bindings before they have loaded.
+var DefaultBindingsCheckInterval = 5 * time.Second
+
+// How long readiness probes reuse the results of probing the mounts.
+var DefaultMountsCheckInterval = 5 * time.Second
+
+// Mounts implementing ProbeableMount can check whether they are able to serve requests.
+type ProbeableMount interface {
+	Probe(timeout time.Duration) error
+}
+
+type ReadinessConfig struct {
+	ProbeMounts      bool   `json:"probeMounts"`      // also require mounts (and at least one upstream of each proxy mount) to be reachable
+	Timeout          string `json:"timeout"`          // how long each mount may take to respond to a probe (default: 2s)
+	BindingsInterval string `json:"bindingsInterval"` // how often probes may evaluate the global bindings until they have loaded (default: 5s)
+	ProbeInterval    string `json:"probeInterval"`    // how often probes may probe the mounts (default: 5s)
+}
+
+func (self *ReadinessConfig) timeout() time.Duration {
+	if d, err := timeutil.ParseDuration(self.Timeout); err == nil && d > 0 {
+		return d
+	}
+
+	return DefaultProbeTimeout
+}
+
+func (self *ReadinessConfig) bindingsInterval() time.Duration {
+	if d, err := timeutil.ParseDuration(self.BindingsInterval); err == nil && d > 0 {
+		return d
+	}
+
+	return DefaultBindingsCheckInterval
+}
+
+func (self *ReadinessConfig) probeInterval() time.Duration {
+	if d, err := timeutil.ParseDuration(self.ProbeInterval); err == nil && d > 0 {
+		return d
+	}
+
+	return DefaultMountsCheckInterval
+}
+
+// The results of the last time a readiness probe probed the mounts.
+type mountsCheck struct {
+	lock      sync.Mutex
+	checkedAt time.Time
+	results   map[Mount]error
+}
+
+// Returns whether there is a result for each of the given mounts that can be probed.
+func (self *mountsCheck) covers(mounts []Mount) bool {
+	for _, mount := range mounts {
+		if _, ok := mount.(ProbeableMount); ok {
+			if _, ok := self.results[mount]; !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// The result of the last time a readiness probe evaluated the global bindings.
+type bindingsCheck struct {
+	lock      sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+type ReadyCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadyStatus struct {
+	Ready  bool         `json:"ready"`
+	Checks []ReadyCheck `json:"checks"`
+}
+
+func (self *ReadyStatus) add(name string, err error) {
+	check := ReadyCheck{
+		Name:   name,
+		Passed: (err == nil),
+	}
+
+	if err != nil {
+		check.Error = redactText(err.Error())
+		self.Ready = false
+	}
+
+	self.Checks = append(self.Checks, check)
+}
+
+// Determine whether the server is ready to serve requests: the prestart and start commands (of this
+// server and its sites) must be running (and have passed their readiness checks) or have exited
+// successfully, the global bindings must have loaded, and (if configured) mounts must be reachable.
+func (self *Server) ReadyStatus() ReadyStatus {
+	status := ReadyStatus{
+		Ready:  true,
+		Checks: make([]ReadyCheck, 0),
+	}
+
+	self.checkReady(&status, ``)
+
+	return status
+}
+
+func (self *Server) checkReady(status *ReadyStatus, prefix string) {
+	for _, scmd := range self.commands() {
+		status.add(prefix+`command:`+scmd.String(), commandReady(scmd))
+	}
+
+	status.add(prefix+`bindings`, self.loadBindings())
+
+	if self.Readiness.ProbeMounts {
+		results := self.probeMounts()
+
+		for _, mount := range self.Mounts {
+			if err, ok := results[mount]; ok {
+				status.add(prefix+`mount:`+mount.GetMountPoint(), err)
+			}
+		}
+	}
+
+	for _, site := range self.Sites {
+		if site.server != nil {
+			site.server.checkReady(status, site.String()+` `)
+		}
+	}
+}
+
+func commandReady(scmd *StartCommand) error {
+	status := scmd.Status()
+
+	if status.Ready || status.State == `exited` {
+		return nil
+	} else if status.LastError != `` {
+		return fmt.Errorf("%v: %v", status.State, status.LastError)
+	} else {
+		return fmt.Errorf("%v", status.State)
+	}
+}
+
+// Global bindings have loaded once they have all been evaluated successfully, either while rendering
+// a page or (if no page has been rendered yet) by evaluating them here.  Since anyone may request the
+// readiness endpoint, the bindings are evaluated by at most one probe at a time, and the result is
+// reused by other probes for Readiness.BindingsInterval.
+func (self *Server) loadBindings() error {
+	if len(self.Bindings) == 0 || atomic.LoadInt32(&self.bindingsLoaded) == 1 {
+		return nil
+	}
+
+	check := &self.bindingsCheck
+	check.lock.Lock()
+	defer check.lock.Unlock()
+
+	if atomic.LoadInt32(&self.bindingsLoaded) == 1 {
+		return nil
+	} else if !check.checkedAt.IsZero() && time.Since(check.checkedAt) < self.Readiness.bindingsInterval() {
+		return check.err
+	}
+
+	if req, err := http.NewRequest(`GET`, self.RoutePrefix+`/`, nil); err == nil {
+		if _, _, err := self.GetTemplateData(req, nil); err != nil {
+			check.err = err
+		} else if atomic.LoadInt32(&self.bindingsLoaded) == 0 {
+			check.err = fmt.Errorf("optional bindings failed")
+		} else {
+			check.err = nil
+		}
+	} else {
+		check.err = err
+	}
+
+	check.checkedAt = time.Now()
+
+	return check.err
+}
+
+// Probe each mount that can be probed.  Like the global bindings, the mounts are probed by at most one
+// readiness probe at a time, and the results are reused by other probes for Readiness.ProbeInterval.
+func (self *Server) probeMounts() map[Mount]error {
+	check := &self.mountsCheck
+	check.lock.Lock()
+	defer check.lock.Unlock()
+
+	if !check.checkedAt.IsZero() && time.Since(check.checkedAt) < self.Readiness.probeInterval() && check.covers(self.Mounts) {
+		return check.results
+	}
+
+	results := make(map[Mount]error)
+
+	for _, mount := range self.Mounts {
+		if probeable, ok := mount.(ProbeableMount); ok {
+			results[mount] = probeable.Probe(self.Readiness.timeout())
+		}
+	}
+
+	check.results = results
+	check.checkedAt = time.Now()
+
+	return results
+}
+
+func (self *Server) serveHealth(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		`status`: `ok`,
+	})
+}
+
+func (self *Server) serveReady(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	status := self.ReadyStatus()
+
+	if status.Ready {
+		writeJSON(w, http.StatusOK, status)
+	} else {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	if data, err := json.Marshal(value); err == nil {
+		w.Header().Set(`Content-Type`, `application/json`)
+		w.Header().Set(`Cache-Control`, `no-store`)
+		w.WriteHeader(code)
+		w.Write(data)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,254 @@
+package diecast
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ghetzel/go-stockutil/log"
+)
+
+var DefaultRedirectCode = http.StatusMovedPermanently
+var RedirectsFile = `/_redirects`
+
+// A RedirectRule sends requests for one path to another.  The source may be an exact path, a glob
+// (containing "*", "**", "?", or "{a,b}"), or a regular expression (starting with "^").  Parts of the
+// source matched by wildcards or capture groups can be used in the destination as $1, $2, etc. (or
+// ${name} for named groups).
+type RedirectRule struct {
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Code          int    `json:"code"`
+	PreserveQuery bool   `json:"preserveQuery"`
+	rewrite       bool
+	rx            *regexp.Regexp
+}
+
+func (self *RedirectRule) compile() error {
+	if self.From == `` || self.To == `` {
+		return fmt.Errorf("must specify a source and destination")
+	}
+
+	var expr string
+
+	if strings.HasPrefix(self.From, `^`) {
+		expr = self.From
+	} else if strings.ContainsAny(self.From, `*?{`) {
+		expr = `^` + globToRegexp(self.From) + `$`
+	} else {
+		expr = `^` + regexp.QuoteMeta(self.From) + `$`
+	}
+
+	if rx, err := regexp.Compile(expr); err == nil {
+		self.rx = rx
+	} else {
+		return err
+	}
+
+	if self.Code == 0 && !self.rewrite {
+		self.Code = DefaultRedirectCode
+	}
+
+	return nil
+}
+
+// Returns the destination for the given request path (and query string), or an empty string if the rule
+// does not match.
+func (self *RedirectRule) destination(requestPath string, query string) string {
+	if self.rx == nil {
+		return ``
+	}
+
+	match := self.rx.FindStringSubmatchIndex(requestPath)
+
+	if match == nil {
+		return ``
+	}
+
+	to := string(self.rx.ExpandString(nil, self.To, requestPath, match))
+
+	// rewrites always keep the query string; the client still sees (and expects) the URL it requested
+	if (self.PreserveQuery || self.rewrite) && query != `` {
+		if u, err := url.Parse(to); err == nil {
+			merged := u.Query()
+
+			if incoming, err := url.ParseQuery(query); err == nil {
+				for k, vs := range incoming {
+					if _, ok := merged[k]; !ok {
+						merged[k] = vs
+					}
+				}
+			}
+
+			u.RawQuery = merged.Encode()
+			to = u.String()
+		}
+	}
+
+	return to
+}
+
+func (self *RedirectRule) String() string {
+	if self.rewrite {
+		return fmt.Sprintf("rewrite %v -> %v", self.From, self.To)
+	} else {
+		return fmt.Sprintf("redirect %v -> %v (HTTP %d)", self.From, self.To, self.Code)
+	}
+}
+
+// Convert a glob into an (unanchored) regular expression in which each wildcard is a capture group.
+func globToRegexp(pattern string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				out.WriteString(`(.*)`)
+				i++
+			} else {
+				out.WriteString(`([^/]*)`)
+			}
+		case '?':
+			out.WriteString(`([^/])`)
+		case '{':
+			if end := strings.IndexByte(pattern[i:], '}'); end > 0 {
+				alternatives := strings.Split(pattern[i+1:i+end], `,`)
+
+				for j, alt := range alternatives {
+					alternatives[j] = regexp.QuoteMeta(alt)
+				}
+
+				out.WriteString(`(` + strings.Join(alternatives, `|`) + `)`)
+				i += end
+			} else {
+				out.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		default:
+			out.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return out.String()
+}
+
+// Parse a redirects file.  Each line consists of a source, a destination, and an optional status code,
+// separated by whitespace.  A status code of 200 makes the rule a rewrite.  Blank lines and lines
+// starting with "#" are ignored.  Query strings are always preserved.
+func ParseRedirectsFile(data []byte) ([]*RedirectRule, error) {
+	rules := make([]*RedirectRule, 0)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	lineno := 0
+
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected 'source destination [code]'", lineno)
+		}
+
+		rule := &RedirectRule{
+			From:          fields[0],
+			To:            fields[1],
+			PreserveQuery: true,
+		}
+
+		if len(fields) == 3 {
+			if code, err := strconv.Atoi(fields[2]); err == nil {
+				if code == http.StatusOK {
+					rule.rewrite = true
+				} else {
+					rule.Code = code
+				}
+			} else {
+				return nil, fmt.Errorf("line %d: invalid status code %q", lineno, fields[2])
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// Assemble the redirect and rewrite rules from the configuration and the redirects file (if present).
+func (self *Server) setupRedirects() error {
+	rules := make([]*RedirectRule, 0)
+
+	for _, rule := range self.Redirects {
+		rule := rule
+		rules = append(rules, &rule)
+	}
+
+	for _, rule := range self.Rewrites {
+		rule := rule
+		rule.rewrite = true
+		rules = append(rules, &rule)
+	}
+
+	if file, err := self.fs.Open(RedirectsFile); err == nil {
+		defer file.Close()
+
+		if data, err := ioutil.ReadAll(file); err == nil {
+			if fileRules, err := ParseRedirectsFile(data); err == nil {
+				rules = append(rules, fileRules...)
+			} else {
+				return fmt.Errorf("%v: %v", RedirectsFile, err)
+			}
+		} else {
+			return err
+		}
+	}
+
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("redirect rule %d: %v", i, err)
+		}
+	}
+
+	self.redirectRules = rules
+	return nil
+}
+
+// Apply the first matching redirect or rewrite rule to the request.  Redirects are written to the
+// response immediately (and true is returned); rewrites modify the request in place so that it is
+// handled as though the client had requested the destination.
+func (self *Server) applyRedirects(w http.ResponseWriter, req *http.Request) bool {
+	requestPath := strings.TrimPrefix(req.URL.Path, self.RoutePrefix)
+
+	for _, rule := range self.redirectRules {
+		if to := rule.destination(requestPath, req.URL.RawQuery); to != `` {
+			if rule.rewrite {
+				if u, err := url.Parse(to); err == nil {
+					log.Debugf("  %v: %v -> %v", rule, req.URL.Path, to)
+
+					req.URL.Path = self.RoutePrefix + u.Path
+					req.URL.RawPath = ``
+					req.URL.RawQuery = u.RawQuery
+				} else {
+					log.Warningf("%v: invalid destination %q: %v", rule, to, err)
+				}
+
+				return false
+			}
+
+			log.Debugf("  %v: %v -> %v", rule, req.URL.Path, to)
+			http.Redirect(w, req, to, rule.Code)
+			return true
+		}
+	}
+
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/ghetzel/go-stockutil/log"
 	"github.com/ghodss/yaml"
@@ -21,25 +22,25 @@ func (self *TemplateRenderer) ShouldPrerender() bool {
 func (self *TemplateRenderer) Render(w http.ResponseWriter, req *http.Request, options RenderOptions) error {
 	defer options.Input.Close()
 
-	// create the template and make it aware of our custom functions
-	tmpl := NewTemplate(
-		self.server.ToTemplateName(options.RequestedPath),
-		GetEngineForFile(options.RequestedPath),
-	)
-
-	tmpl.Funcs(options.FunctionSet)
-	tmpl.SetHeaderOffset(options.HeaderOffset)
-
-	// if delim := options.Header.Delimiters; len(delim) == 2 {
-	// 	tmpl.SetDelimiters(delim[0], delim[1])
-	// }
-
-	if err := tmpl.AddPostProcessors(options.Header.Postprocessors...); err != nil {
-		return err
-	}
-
 	if data, err := ioutil.ReadAll(options.Input); err == nil {
-		if err := tmpl.Parse(string(data)); err == nil {
+		// get the (possibly cached) template and make it aware of our custom functions
+		if tmpl, done, err := self.server.parsedTemplate(
+			self.server.ToTemplateName(options.RequestedPath),
+			GetEngineForFile(options.RequestedPath),
+			options.FunctionSet,
+			options.HeaderOffset,
+			string(data),
+		); err == nil {
+			defer done()
+
+			// if delim := options.Header.Delimiters; len(delim) == 2 {
+			// 	tmpl.SetDelimiters(delim[0], delim[1])
+			// }
+
+			if err := tmpl.AddPostProcessors(options.Header.Postprocessors...); err != nil {
+				return err
+			}
+
 			log.Debugf("Rendering %q as %v template (header offset by %d lines)", options.RequestedPath, tmpl.Engine(), options.HeaderOffset)
 
 			if options.Header != nil {
@@ -72,11 +73,17 @@ func (self *TemplateRenderer) Render(w http.ResponseWriter, req *http.Request, o
 			} else {
 				w.Header().Set(`Content-Type`, options.MimeType)
 
+				subtemplate := ``
+
 				if options.HasLayout {
-					return tmpl.Render(w, options.Data, `layout`)
-				} else {
-					return tmpl.Render(w, options.Data, ``)
+					subtemplate = `layout`
 				}
+
+				started := time.Now()
+				err := tmpl.Render(w, options.Data, subtemplate)
+				self.server.metricsRegistry().templateRender.Observe(time.Since(started), tmpl.Engine().String())
+
+				return err
 			}
 		} else if self.server.ShouldReturnSource(req) {
 			var tplstr string
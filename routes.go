@@ -0,0 +1,236 @@
+package diecast
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+var DefaultRouteMethods = []string{`GET`, `HEAD`}
+var RoutableMethods = []string{`GET`, `HEAD`, `POST`, `PUT`, `PATCH`, `DELETE`, `OPTIONS`}
+
+var rxBracketedName = regexp.MustCompile(`^\[([^\[\]/]+)\]$`)
+
+// A Route maps a URL pattern to the template that should be rendered for matching requests.  Patterns
+// may contain named parameters (e.g.: "/users/:user") that match a single path segment, and may end
+// in a catch-all parameter (e.g.: "/docs/*path") that matches the remainder of the path.
+type Route struct {
+	Path     string   `json:"path"`
+	Template string   `json:"template"`
+	Methods  []string `json:"methods"`
+}
+
+func (self *Server) setupRoutes() (err error) {
+	if len(self.Routes) == 0 {
+		self.router = nil
+		return nil
+	}
+
+	router := httprouter.New()
+
+	// httprouter panics on conflicting or malformed patterns; surface that as a configuration error
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid route: %v", r)
+		}
+	}()
+
+	for i, route := range self.Routes {
+		if route.Path == `` || route.Template == `` {
+			return fmt.Errorf("route %d: must specify a path and a template", i)
+		}
+
+		route := route
+		methods := route.Methods
+
+		if len(methods) == 0 {
+			methods = DefaultRouteMethods
+		}
+
+		for _, method := range methods {
+			router.Handle(strings.ToUpper(method), route.Path, func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+				self.serveRoute(w, req, &route, params)
+			})
+		}
+
+		log.Debugf("route %v -> %v", route.Path, route.Template)
+	}
+
+	self.router = router
+	return nil
+}
+
+// Return the methods that declared routes will accept for the given path.
+func (self *Server) routeMethodsFor(requestPath string) []string {
+	allowed := make([]string, 0)
+
+	for _, method := range RoutableMethods {
+		if handle, _, _ := self.router.Lookup(method, strings.TrimPrefix(requestPath, self.RoutePrefix)); handle != nil {
+			allowed = append(allowed, method)
+		}
+	}
+
+	return allowed
+}
+
+// URL parameters are available to templates both by name and by (1-based) position.
+func routeParamsToMap(params httprouter.Params) map[string]interface{} {
+	urlParams := make(map[string]interface{})
+
+	for i, param := range params {
+		urlParams[param.Key] = param.Value
+		urlParams[fmt.Sprintf("%d", i+1)] = param.Value
+	}
+
+	return urlParams
+}
+
+func (self *Server) serveRoute(w http.ResponseWriter, req *http.Request, route *Route, params httprouter.Params) {
+	log.Debugf("  matched route %v -> %v", route.Path, route.Template)
+	requestLog(req).Route = route.Path
+
+	if !self.tryPaths(w, req, []string{self.RoutePrefix + route.Template}, routeParamsToMap(params)) {
+		self.respondError(w, fmt.Errorf("Template %q for route %q was not found.", route.Template, route.Path), http.StatusNotFound)
+	}
+}
+
+// Attempt to match the request path against files and directories in the root filesystem whose
+// names are bracketed placeholders (e.g.: "/[user]/[post].html").  Each placeholder matches one path
+// segment, and its value is exposed as a URL parameter.  Exact names take precedence over placeholders.
+func (self *Server) tryFileRoutes(w http.ResponseWriter, req *http.Request, requestPath string) bool {
+	segments := make([]string, 0)
+
+	for _, segment := range strings.Split(strings.TrimPrefix(requestPath, self.RoutePrefix), `/`) {
+		if segment != `` {
+			segments = append(segments, segment)
+		}
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+
+	if filename, params, ok := self.matchFileRoute(`/`, segments, nil); ok && len(params) > 0 {
+		log.Debugf("  matched file route %v", filename)
+		return self.tryPaths(w, req, []string{self.RoutePrefix + filename}, routeParamsToMap(params))
+	}
+
+	return false
+}
+
+func (self *Server) matchFileRoute(dir string, segments []string, params httprouter.Params) (string, httprouter.Params, bool) {
+	entries, err := self.readdir(dir)
+
+	if err != nil {
+		return ``, nil, false
+	}
+
+	if len(segments) == 0 {
+		for _, entry := range entries {
+			if !entry.IsDir() && entry.Name() == self.IndexFile {
+				return path.Join(dir, entry.Name()), params, true
+			}
+		}
+
+		return ``, nil, false
+	}
+
+	segment := segments[0]
+
+	// the last segment may refer to a file
+	if len(segments) == 1 {
+		for _, placeholders := range []bool{false, true} {
+			for _, entry := range entries {
+				if entry.IsDir() {
+					continue
+				}
+
+				if value, name, ok := self.fileRouteSegmentMatches(entry.Name(), segment, placeholders); ok {
+					if name != `` {
+						params = append(params[:len(params):len(params)], httprouter.Param{Key: name, Value: value})
+					}
+
+					return path.Join(dir, entry.Name()), params, true
+				}
+			}
+		}
+	}
+
+	for _, placeholders := range []bool{false, true} {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+
+			sub := params
+
+			if placeholders {
+				if match := rxBracketedName.FindStringSubmatch(entry.Name()); match != nil {
+					sub = append(params[:len(params):len(params)], httprouter.Param{Key: match[1], Value: segment})
+				} else {
+					continue
+				}
+			} else if entry.Name() != segment {
+				continue
+			}
+
+			if filename, matched, ok := self.matchFileRoute(path.Join(dir, entry.Name()), segments[1:], sub); ok {
+				return filename, matched, true
+			}
+		}
+	}
+
+	return ``, nil, false
+}
+
+// Returns whether the given filename matches the request path segment, either exactly (possibly with
+// one of the TryExtensions appended), or as a placeholder.  For placeholder matches, the parameter
+// name and value are returned.
+func (self *Server) fileRouteSegmentMatches(filename string, segment string, placeholders bool) (string, string, bool) {
+	if !placeholders {
+		if filename == segment {
+			return ``, ``, true
+		}
+
+		for _, ext := range self.TryExtensions {
+			if filename == segment+`.`+ext {
+				return ``, ``, true
+			}
+		}
+
+		return ``, ``, false
+	}
+
+	ext := path.Ext(filename)
+
+	if match := rxBracketedName.FindStringSubmatch(strings.TrimSuffix(filename, ext)); match != nil {
+		// "[post].json" matches "42.json"
+		if ext != `` && strings.HasSuffix(segment, ext) {
+			return strings.TrimSuffix(segment, ext), match[1], true
+		}
+
+		// "[post].html" matches "42"
+		for _, tryExt := range self.TryExtensions {
+			if ext == `.`+tryExt && path.Ext(segment) == `` {
+				return segment, match[1], true
+			}
+		}
+	}
+
+	return ``, ``, false
+}
+
+func (self *Server) readdir(dir string) ([]os.FileInfo, error) {
+	if file, err := self.fs.Open(dir); err == nil {
+		defer file.Close()
+		return file.Readdir(-1)
+	} else {
+		return nil, err
+	}
+}
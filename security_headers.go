@@ -0,0 +1,83 @@
+package diecast
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The placeholder in a Content-Security-Policy that is replaced with each request's nonce.
+var CspNoncePlaceholder = `{nonce}`
+
+// Headers that are added to every response.  The Content-Security-Policy may refer to a nonce that is
+// generated for each request (e.g.: "script-src 'nonce-{nonce}'"); templates can use it as $.csp_nonce.
+type SecurityHeadersConfig struct {
+	HSTS                  string `json:"hsts"`                    // Strict-Transport-Security (e.g.: "max-age=31536000; includeSubDomains")
+	FrameOptions          string `json:"frame_options"`           // X-Frame-Options (e.g.: "DENY" or "SAMEORIGIN")
+	ReferrerPolicy        string `json:"referrer_policy"`         // Referrer-Policy (e.g.: "strict-origin-when-cross-origin")
+	PermissionsPolicy     string `json:"permissions_policy"`      // Permissions-Policy (e.g.: "camera=(), geolocation=()")
+	ContentSecurityPolicy string `json:"content_security_policy"` // Content-Security-Policy, in which "{nonce}" is replaced with the request's nonce
+}
+
+func (self *SecurityHeadersConfig) IsEmpty() bool {
+	return (*self == SecurityHeadersConfig{})
+}
+
+// Return the nonce generated for the given request, if any.
+func cspNonce(req *http.Request) string {
+	if nonce, ok := req.Context().Value(`diecast-csp-nonce`).(string); ok {
+		return nonce
+	}
+
+	return ``
+}
+
+func newCspNonce() (string, error) {
+	data := make([]byte, 16)
+
+	if _, err := rand.Read(data); err != nil {
+		return ``, err
+	}
+
+	// URL-safe characters aren't escaped when the nonce is used in templates
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Middleware that adds the configured security headers to every response.
+func (self *Server) addSecurityHeaders(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	config := &self.SecurityHeaders
+	header := w.Header()
+
+	if config.HSTS != `` {
+		header.Set(`Strict-Transport-Security`, config.HSTS)
+	}
+
+	if config.FrameOptions != `` {
+		header.Set(`X-Frame-Options`, config.FrameOptions)
+	}
+
+	if config.ReferrerPolicy != `` {
+		header.Set(`Referrer-Policy`, config.ReferrerPolicy)
+	}
+
+	if config.PermissionsPolicy != `` {
+		header.Set(`Permissions-Policy`, config.PermissionsPolicy)
+	}
+
+	if policy := config.ContentSecurityPolicy; policy != `` {
+		if nonce, err := newCspNonce(); err == nil {
+			req = req.WithContext(context.WithValue(req.Context(), `diecast-csp-nonce`, nonce))
+			policy = strings.Replace(policy, CspNoncePlaceholder, nonce, -1)
+		} else {
+			self.respondError(w, fmt.Errorf("failed to generate nonce: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		header.Set(`Content-Security-Policy`, policy)
+	}
+
+	next(w, req)
+}
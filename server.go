@@ -4,7 +4,7 @@ package diecast
 
 import (
 	"bytes"
-	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -17,9 +17,10 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
-	"syscall"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/fatih/structs"
 	"github.com/ghetzel/go-stockutil/fileutil"
@@ -30,12 +31,9 @@ import (
 	"github.com/ghetzel/go-stockutil/pathutil"
 	"github.com/ghetzel/go-stockutil/sliceutil"
 	"github.com/ghetzel/go-stockutil/stringutil"
-	"github.com/ghetzel/go-stockutil/timeutil"
 	"github.com/ghetzel/go-stockutil/typeutil"
 	"github.com/ghodss/yaml"
-	"github.com/jbenet/go-base58"
 	"github.com/julienschmidt/httprouter"
-	"github.com/mattn/go-shellwords"
 	"github.com/urfave/negroni"
 )
 
@@ -65,16 +63,6 @@ func (self RedirectTo) Error() string {
 	return string(self)
 }
 
-type StartCommand struct {
-	Command          string                 `json:"command"`
-	Directory        string                 `json:"directory"`
-	Environment      map[string]interface{} `json:"env"`
-	WaitBefore       string                 `json:"delay"`
-	Wait             string                 `json:"timeout"`
-	ExitOnCompletion bool                   `json:"exitOnCompletion"`
-	cmd              *exec.Cmd
-}
-
 type Server struct {
 	BinPath             string                 `json:"-"`
 	Address             string                 `json:"address"`
@@ -97,17 +85,68 @@ type Server struct {
 	DefaultPageObject   map[string]interface{} `json:"-"`
 	OverridePageObject  map[string]interface{} `json:"-"`
 	PrestartCommand     StartCommand           `json:"prestart"`
-	StartCommand        StartCommand           `json:"start"`
+	StartCommands       StartCommands          `json:"start"`
 	Authenticators      AuthenticatorConfigs   `json:"authenticators"`
 	TryExtensions       []string               `json:"tryExtensions"`   // try these file extensions when looking for default (i.e.: "index") files
 	RendererMappings    map[string]string      `json:"rendererMapping"` // map file extensions to preferred renderers
 	AutolayoutPatterns  []string               `json:"autolayoutPatterns"`
+	Writable            bool                   `json:"writable"`          // accept PUT, DELETE, MKCOL, and WebDAV requests for files in the root path
+	MaxWriteSize        int64                  `json:"maxWriteSize"`      // the largest file (in bytes) that can be written
+	Autoindex           AutoindexConfig        `json:"autoindex"`         // render listings for directories that don't have an index file
+	Routes              []Route                `json:"routes"`            // map URL patterns (with named parameters) to templates
+	Redirects           []RedirectRule         `json:"redirects"`         // send requests for matching paths elsewhere
+	Rewrites            []RedirectRule         `json:"rewrites"`          // serve matching paths as though another path was requested
+	Sites               []*Site                `json:"sites"`             // serve other sites from this process, selected by the Host header
+	TLS                 *TlsConfig             `json:"tls"`               // serve HTTPS (and HTTP/2) directly
+	ShutdownTimeout     string                 `json:"shutdownTimeout"`   // how long to wait for in-flight requests and commands to finish when shutting down
+	Listeners           []string               `json:"listeners"`         // additional addresses to listen on (host:port, or unix:/path/to.sock)
+	SocketMode          string                 `json:"socketMode"`        // octal file mode for Unix sockets (e.g.: "0660")
+	SocketOwner         string                 `json:"socketOwner"`       // owner of Unix sockets, as "user", "user:group", or ":group"
+	Watch               bool                   `json:"watch"`             // reload browsers (and the configuration) when files change; for development
+	TemplateCacheSize   int                    `json:"templateCacheSize"` // how many template files and parsed templates to keep in memory (negative to disable)
+	PageCacheSize       int                    `json:"pageCacheSize"`     // how many rendered pages (with a "cache" policy) to keep in memory
+	Compression         CompressionConfig      `json:"compression"`       // compress responses with gzip or brotli
+	AccessLog           AccessLogConfig        `json:"accessLog"`         // where and how to log requests
+	Metrics             MetricsConfig          `json:"metrics"`           // serve Prometheus metrics at /_diecast/metrics
+	Introspection       IntrospectionConfig    `json:"introspection"`     // describe the server's configuration and state at /_diecast (and below)
+	Readiness           ReadinessConfig        `json:"readiness"`         // what /_diecast/ready checks in addition to start commands and bindings
+	Limits              LimitsConfig           `json:"limits"`            // per-client rate limits and request size limits
+	Cors                []CorsPolicy           `json:"cors"`              // which other origins may make requests to matching paths
+	SecurityHeaders     SecurityHeadersConfig  `json:"security_headers"`  // headers (e.g.: HSTS, Content-Security-Policy) added to every response
 	router              *httprouter.Router
 	server              *negroni.Negroni
+	mux                 *http.ServeMux
 	fs                  http.FileSystem
 	fsIsSet             bool
 	fileServer          http.Handler
 	precmd              *exec.Cmd
+	redirectRules       []*RedirectRule
+	httpServers         []*http.Server
+	httpServersLock     sync.Mutex
+	configFile          string
+	configMounts        []Mount
+	configDefaults      map[string]json.RawMessage
+	configValues        map[string]interface{}
+	host                *Server
+	reloaded            atomic.Value
+	reloadLock          sync.Mutex
+	mountOrder          []Mount
+	liveReload          *liveReloadHub
+	watchStop           chan struct{}
+	watchStopOnce       sync.Once
+	fileCache           *lruCache
+	templateCache       *lruCache
+	templateCacheInit   sync.Once
+	pageCache           *lruCache
+	pageCacheInit       sync.Once
+	pageCacheStale      int64
+	metrics             *metricsRegistry
+	metricsInit         sync.Once
+	accessLog           io.Writer
+	accessLogLock       sync.Mutex
+	bindingsLoaded      int32
+	bindingsCheck       bindingsCheck
+	mountsCheck         mountsCheck
 }
 
 func NewServer(root string, patterns ...string) *Server {
@@ -146,41 +185,154 @@ func (self *Server) ShouldReturnSource(req *http.Request) bool {
 
 func (self *Server) LoadConfig(filename string) error {
 	if pathutil.FileExists(filename) {
+		if abs, err := filepath.Abs(filename); err == nil {
+			self.configFile = abs
+		}
+
 		if file, err := os.Open(filename); err == nil {
+			defer file.Close()
+
 			if data, err := ioutil.ReadAll(file); err == nil && len(data) > 0 {
-				if err := yaml.Unmarshal(data, self); err == nil {
-					// process mount configs into mount instances
-					for i, config := range self.MountConfigs {
-						if mount, err := NewMountFromSpec(fmt.Sprintf("%s:%s", config.Mount, config.To)); err == nil {
-							mstruct := structs.New(mount)
-
-							for k, v := range config.Options {
-								for _, field := range mstruct.Fields() {
-									if tag := field.Tag(`json`); tag != `` {
-										if tag == k || strings.HasPrefix(tag, k+`,`) {
-											if err := field.Set(v); err != nil {
-												return fmt.Errorf("mount %d: field %v error: %v", i, k, err)
-											}
-
-											break
-										}
-									}
-								}
-							}
+				return self.loadConfigData(data)
+			} else {
+				return err
+			}
+		} else {
+			return err
+		}
+	}
 
-							self.Mounts = append(self.Mounts, mount)
-						} else {
-							return fmt.Errorf("invalid mount %d: %v", i, err)
-						}
+	return nil
+}
+
+// Apply the given YAML (or JSON) configuration to the server.
+func (self *Server) loadConfigData(data []byte) error {
+	var values map[string]interface{}
+
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	self.recordConfigDefaults(values)
+	self.configValues = values
+
+	if err := yaml.Unmarshal(data, self); err == nil {
+		// when the configuration is reloaded, replace the mounts it created the last time
+		if len(self.configMounts) > 0 {
+			mounts := make([]Mount, 0)
+
+			for _, mount := range self.Mounts {
+				if !isConfigMount(self.configMounts, mount) {
+					mounts = append(mounts, mount)
+				}
+			}
+
+			closeMounts(self.configMounts)
+			self.Mounts = mounts
+			self.configMounts = nil
+		}
+
+		// process mount configs into mount instances
+		for i, config := range self.MountConfigs {
+			if mount, err := NewMountFromSpec(fmt.Sprintf("%s:%s", config.Mount, config.To)); err == nil {
+				mstruct := structs.New(mount)
+
+				for k, v := range config.Options {
+					if err := setMountOption(mstruct.Fields(), k, v); err != nil {
+						return fmt.Errorf("mount %d: field %v error: %v", i, k, err)
+					}
+				}
+
+				self.Mounts = append(self.Mounts, mount)
+				self.configMounts = append(self.configMounts, mount)
+			} else {
+				return fmt.Errorf("invalid mount %d: %v", i, err)
+			}
+		}
+
+		self.sortMounts()
+		return nil
+	} else {
+		return err
+	}
+}
+
+// Remember what each of the given configuration keys was set to before a configuration file first set
+// it, so that removing the key from the file and reloading puts it back.
+func (self *Server) recordConfigDefaults(values map[string]interface{}) {
+	if self.configDefaults == nil {
+		self.configDefaults = make(map[string]json.RawMessage)
+	}
+
+	for key := range values {
+		if _, ok := self.configDefaults[key]; ok {
+			continue
+		}
+
+		if field, ok := self.configField(key); ok {
+			if data, err := json.Marshal(field.Interface()); err == nil {
+				self.configDefaults[key] = data
+			}
+		}
+	}
+}
+
+// Return the field that the given top-level configuration key sets.
+func (self *Server) configField(key string) (reflect.Value, bool) {
+	server := reflect.ValueOf(self).Elem()
+
+	for i := 0; i < server.NumField(); i++ {
+		if field := server.Type().Field(i); field.PkgPath == `` {
+			if name := strings.Split(field.Tag.Get(`json`), `,`)[0]; name == key {
+				return server.Field(i), true
+			}
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+func isConfigMount(configMounts []Mount, mount Mount) bool {
+	for _, m := range configMounts {
+		if m == mount {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Set the mount field whose JSON tag matches the given option name (including the fields of embedded
+// structs like MountMatcher).  Options decoded from YAML are only ever strings, float64s, bools, lists,
+// and maps, so values are converted to the field's type by way of JSON.  Unknown options are ignored.
+func setMountOption(fields []*structs.Field, name string, value interface{}) error {
+	for _, field := range fields {
+		if !field.IsExported() {
+			continue
+		} else if tag := field.Tag(`json`); tag != `` {
+			if tag == name || strings.HasPrefix(tag, name+`,`) {
+				ftype := reflect.TypeOf(field.Value())
+
+				if ftype == nil {
+					return fmt.Errorf("cannot be set from configuration")
+				}
+
+				target := reflect.New(ftype)
+
+				if data, err := json.Marshal(value); err == nil {
+					if err := json.Unmarshal(data, target.Interface()); err == nil {
+						return field.Set(target.Elem().Interface())
+					} else {
+						return err
 					}
 				} else {
 					return err
 				}
-			} else {
+			}
+		} else if field.IsEmbedded() && field.Kind() == reflect.Struct {
+			if err := setMountOption(field.Fields(), name, value); err != nil {
 				return err
 			}
-		} else {
-			return err
 		}
 	}
 
@@ -193,6 +345,8 @@ func (self *Server) SetMounts(mounts []Mount) {
 	} else {
 		self.Mounts = mounts
 	}
+
+	self.sortMounts()
 }
 
 func (self *Server) SetFileSystem(fs http.FileSystem) {
@@ -230,6 +384,13 @@ func (self *Server) Initialize() error {
 
 	self.fileServer = http.FileServer(self.fs)
 
+	// the mounts may have been assigned directly rather than via SetMounts
+	self.sortMounts()
+
+	if err := startMounts(self.Mounts); err != nil {
+		return err
+	}
+
 	// allocate ephemeral address if we're supposed to
 	if addr, port, err := net.SplitHostPort(self.Address); err == nil {
 		if port == `0` {
@@ -257,29 +418,130 @@ func (self *Server) Initialize() error {
 		binding.server = self
 	}
 
+	if err := self.setupRoutes(); err != nil {
+		return err
+	}
+
+	if err := self.setupRedirects(); err != nil {
+		return err
+	}
+
+	// sites and the prestart command are left as they are when the configuration is reloaded
+	if self.host == nil {
+		if err := self.setupSites(); err != nil {
+			return err
+		}
+	}
+
 	if err := self.setupServer(); err != nil {
 		return err
 	}
 
+	if self.host != nil {
+		return nil
+	}
+
 	return self.RunStartCommand(&self.PrestartCommand, false)
 }
 
-func (self *Server) Serve() error {
-	go func() {
-		if err := self.RunStartCommand(&self.StartCommand, true); err != nil {
-			log.Errorf("start command failed: %v", err)
+// Start the start commands, wait for them to become ready, then serve requests until the server is
+// shut down.  The TLS configuration is loaded and every address is bound before any start commands are
+// run, and if serving fails, the prestart and start commands are stopped rather than left running.
+func (self *Server) Serve() (err error) {
+	var listeners []net.Listener
+	var redirector *http.Server
+	var redirectListener net.Listener
 
-			if self.StartCommand.ExitOnCompletion {
-				self.cleanupCommands()
-				os.Exit(1)
-			}
-		} else if self.StartCommand.ExitOnCompletion {
-			self.cleanupCommands()
-			os.Exit(0)
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for _, listener := range listeners {
+			listener.Close()
 		}
+
+		if redirector != nil {
+			redirector.Close()
+		} else if redirectListener != nil {
+			redirectListener.Close()
+		}
+
+		self.stopWatching()
+		self.cleanupCommands()
 	}()
 
-	return http.ListenAndServe(self.Address, self.server)
+	srv := self.newHttpServer(self.Address, self)
+
+	if self.TLS.Enabled() {
+		host, _, _ := net.SplitHostPort(self.Address)
+
+		if tlsConfig, err := self.TLS.tlsConfig(host); err == nil {
+			srv.TLSConfig = tlsConfig
+
+			if self.TLS.DisableHTTP2 {
+				srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+			}
+		} else {
+			return fmt.Errorf("TLS configuration error: %v", err)
+		}
+
+		if addr := self.TLS.RedirectAddress; addr != `` {
+			if redirectListener, err = net.Listen(`tcp`, addr); err != nil {
+				return fmt.Errorf("HTTPS redirect listener failed: %v", err)
+			}
+		}
+	}
+
+	if listeners, err = self.listen(); err != nil {
+		return err
+	}
+
+	self.runStartCommands(self)
+
+	if self.Watch {
+		self.startWatching()
+	}
+
+	// commands with readiness checks must be ready before we start accepting requests
+	if err = self.waitForCommands(); err != nil {
+		return err
+	}
+
+	if redirectListener != nil {
+		redirector = self.newHttpServer(redirectListener.Addr().String(), httpsRedirectHandler(self.Address))
+
+		go func() {
+			log.Infof("Redirecting HTTP requests on %v to HTTPS", redirector.Addr)
+
+			if err := redirector.Serve(redirectListener); err != nil && err != http.ErrServerClosed {
+				log.Errorf("HTTPS redirect listener failed: %v", err)
+			}
+		}()
+	}
+
+	errchan := make(chan error, len(listeners))
+	useTLS := srv.TLSConfig != nil
+
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if useTLS {
+				errchan <- ignoreServerClosed(srv.ServeTLS(listener, ``, ``))
+			} else {
+				errchan <- ignoreServerClosed(srv.Serve(listener))
+			}
+		}(listener)
+	}
+
+	// wait for every listener to stop, returning the first error encountered
+	for range listeners {
+		if lerr := <-errchan; lerr != nil && err == nil {
+			err = lerr
+			srv.Close()
+		}
+	}
+
+	return err
 }
 
 func (self *Server) ListenAndServe(address string) error {
@@ -288,6 +550,18 @@ func (self *Server) ListenAndServe(address string) error {
 }
 
 func (self *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// once the configuration has been reloaded, requests are handled by the server it was loaded into
+	if current := self.current(); current != self {
+		current.ServeHTTP(w, req)
+		return
+	}
+
+	// requests for hostnames belonging to another site are handed off to that site's server
+	if site := self.siteFor(req); site != nil {
+		site.server.ServeHTTP(w, req)
+		return
+	}
+
 	self.server.ServeHTTP(w, req)
 }
 
@@ -335,6 +609,8 @@ func (self *Server) applyTemplate(w http.ResponseWriter, req *http.Request, requ
 	headers := make([]*TemplateHeader, 0)
 	layouts := make([]string, 0)
 
+	requestLog(req).Template = requestPath
+
 	if header != nil {
 		headers = append(headers, header)
 
@@ -365,7 +641,8 @@ func (self *Server) applyTemplate(w http.ResponseWriter, req *http.Request, requ
 		if !strings.HasPrefix(path.Base(requestPath), `_`) {
 			// if no layouts were explicitly specified, and a layout named "default" exists, add it to the list
 			if len(layouts) == 0 {
-				if _, err := self.LoadLayout(`default`); err == nil {
+				if layoutFile, err := self.LoadLayout(`default`); err == nil {
+					layoutFile.Close()
 					layouts = append(layouts, `default`)
 				}
 			}
@@ -375,7 +652,10 @@ func (self *Server) applyTemplate(w http.ResponseWriter, req *http.Request, requ
 					layoutName = EvalInline(layoutName, nil, earlyFuncs)
 
 					if layoutFile, err := self.LoadLayout(layoutName); err == nil {
-						if layoutHeader, layoutData, err := SplitTemplateHeaderContent(layoutFile); err == nil {
+						layoutHeader, layoutData, err := self.splitTemplateFile(self.layoutFilename(layoutName), layoutFile)
+						layoutFile.Close()
+
+						if err == nil {
 							if layoutHeader != nil {
 								headers = append([]*TemplateHeader{layoutHeader}, headers...)
 
@@ -425,6 +705,24 @@ func (self *Server) applyTemplate(w http.ResponseWriter, req *http.Request, requ
 		finalHeader.UrlParams = urlParams
 	}
 
+	// pages with a cache policy are served from the page cache (before any bindings are evaluated),
+	// and stored in it once they have been rendered
+	if writer, ok := w.(*pageCacheWriter); ok && writer.policy == nil && finalHeader.Cache != nil {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			if !self.ShouldReturnSource(req) {
+				if self.servePageFromCache(w, req, finalHeader.Cache) {
+					return nil
+				}
+
+				writer.policy = finalHeader.Cache
+
+				for _, tag := range finalHeader.Cache.Tags {
+					writer.tags = append(writer.tags, EvalInline(tag, nil, earlyFuncs))
+				}
+			}
+		}
+	}
+
 	if funcs, data, err := self.GetTemplateData(req, finalHeader); err == nil {
 		// switches allow the template processing to be hijacked/redirected mid-evaluation
 		// based on data already evaluated
@@ -443,7 +741,9 @@ func (self *Server) applyTemplate(w http.ResponseWriter, req *http.Request, requ
 					}
 
 					if swTemplate, err := self.fs.Open(swcase.UsePath); err == nil {
-						if swHeader, swData, err := SplitTemplateHeaderContent(swTemplate); err == nil {
+						defer swTemplate.Close()
+
+						if swHeader, swData, err := self.splitTemplateFile(swcase.UsePath, swTemplate); err == nil {
 							finalHeader.Switch[i] = nil
 
 							if fh, err := finalHeader.Merge(swHeader); err == nil {
@@ -753,8 +1053,12 @@ func makeVarKey(key string, post ...string) []string {
 	return output
 }
 
-func (self *Server) LoadLayout(name string) (io.Reader, error) {
-	return self.fs.Open(fmt.Sprintf("%s/%s.html", self.LayoutPath, name))
+func (self *Server) LoadLayout(name string) (http.File, error) {
+	return self.fs.Open(self.layoutFilename(name))
+}
+
+func (self *Server) layoutFilename(name string) string {
+	return fmt.Sprintf("%s/%s.html", self.LayoutPath, name)
 }
 
 func (self *Server) ToTemplateName(requestPath string) string {
@@ -777,6 +1081,9 @@ func (self *Server) GetTemplateData(req *http.Request, header *TemplateHeader) (
 		`verify_file`:       self.VerifyFile,
 	}
 
+	// used to permit inline scripts and styles by the Content-Security-Policy
+	data[`csp_nonce`] = cspNonce(req)
+
 	// these are the functions that will be available to every part of the rendering process
 	funcs := self.GetTemplateFunctions(data)
 
@@ -829,8 +1136,11 @@ func (self *Server) GetTemplateData(req *http.Request, header *TemplateHeader) (
 		bindingsToEval = append(bindingsToEval, header.Bindings...)
 	}
 
-	for _, binding := range bindingsToEval {
+	globalBindingsFailed := false
+
+	for n, binding := range bindingsToEval {
 		binding.server = self
+		isGlobal := (n < len(self.Bindings))
 
 		if binding.Repeat == `` {
 			bindings[binding.Name] = binding.Fallback
@@ -844,6 +1154,10 @@ func (self *Server) GetTemplateData(req *http.Request, header *TemplateHeader) (
 			} else {
 				log.Warningf("Binding %q failed: %v", binding.Name, err)
 
+				if isGlobal {
+					globalBindingsFailed = true
+				}
+
 				if !binding.Optional {
 					return funcs, nil, err
 				}
@@ -878,6 +1192,10 @@ func (self *Server) GetTemplateData(req *http.Request, header *TemplateHeader) (
 				} else {
 					log.Warningf("Binding %q (iteration %d) failed: %v", binding.Name, i, err)
 
+					if isGlobal {
+						globalBindingsFailed = true
+					}
+
 					if binding.OnError == ActionContinue {
 						continue
 					} else if binding.OnError == ActionBreak {
@@ -894,6 +1212,12 @@ func (self *Server) GetTemplateData(req *http.Request, header *TemplateHeader) (
 
 	data[`bindings`] = bindings
 
+	// every global binding has been evaluated successfully at least once (see ReadyStatus); optional
+	// bindings that failed don't count
+	if !globalBindingsFailed {
+		atomic.StoreInt32(&self.bindingsLoaded, 1)
+	}
+
 	// Evaluate "flags" data: this data is templatized, and has access to $.page and $.bindings
 	// ---------------------------------------------------------------------------------------------
 	if header != nil {
@@ -917,24 +1241,74 @@ func (self *Server) GetTemplateData(req *http.Request, header *TemplateHeader) (
 func (self *Server) handleFileRequest(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 
-	log.Infof("%v %v", req.Method, req.URL)
+	// redirects respond immediately, rewrites change which path is handled (and authenticated) below
+	if self.applyRedirects(w, req) {
+		return
+	}
+
+	var authenticated bool
 
 	if auth, err := self.Authenticators.Authenticator(req); err == nil {
 		if auth != nil {
 			if auth.IsCallback(req.URL) {
+				self.observeAuthentication(auth, `callback`)
 				auth.Callback(w, req)
 				return
-			} else if !auth.Authenticate(w, req) {
+			} else if !self.authenticate(auth, w, req) {
 				return
 			}
+
+			authenticated = true
 		}
 	} else {
 		self.respondError(w, err, http.StatusInternalServerError)
 	}
 
+	// rate limits for authenticated users
+	if !self.allowRequest(w, req, true) {
+		return
+	}
+
 	// normalize filename from request path
 	requestPath := req.URL.Path
 
+	// writes (and WebDAV requests) to writable mounts are only permitted on paths that are
+	// protected by an authenticator
+	if isWritableMethod(req.Method) {
+		if target := self.writableTargetFor(requestPath, req); target != nil {
+			if authenticated {
+				self.handleWriteRequest(w, req, target)
+			} else {
+				self.respondError(w, fmt.Errorf("Writing to %q requires authentication.", requestPath), http.StatusForbidden)
+			}
+
+			return
+		}
+	}
+
+	// long-lived streaming requests are handed off to the first mount willing to handle them
+	if mount := self.streamingMountFor(requestPath, req); mount != nil {
+		requestLog(req).Mount = mount.GetMountPoint()
+
+		if err := mount.ServeStream(w, req, strings.TrimPrefix(requestPath, self.RoutePrefix)); err != nil {
+			self.respondError(w, err, http.StatusBadGateway)
+		}
+
+		return
+	}
+
+	// declared routes take precedence over searching for files
+	if self.router != nil {
+		if handle, params, _ := self.router.Lookup(req.Method, strings.TrimPrefix(requestPath, self.RoutePrefix)); handle != nil {
+			handle(w, req, params)
+			return
+		} else if allowed := self.routeMethodsFor(requestPath); len(allowed) > 0 {
+			w.Header().Set(`Allow`, strings.Join(allowed, `, `))
+			self.respondError(w, fmt.Errorf("Method %v is not allowed for %q.", req.Method, requestPath), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
 	requestPaths := []string{
 		requestPath,
 	}
@@ -971,9 +1345,32 @@ func (self *Server) handleFileRequest(w http.ResponseWriter, req *http.Request)
 		}
 	}
 
+	if self.tryPaths(w, req, requestPaths, nil) {
+		return
+	}
+
+	// paths containing bracketed placeholders (e.g.: "/[user]/[post].html") match any single path segment
+	if self.tryFileRoutes(w, req, requestPath) {
+		return
+	}
+
+	// directories without an index file may be listed instead
+	if self.tryAutoindex(w, req, requestPath) {
+		return
+	}
+
+	// if we got *here*, then File Not Found
+	// log.Debugf("< not found")
+
+	self.respondError(w, fmt.Errorf("File %q was not found.", requestPath), http.StatusNotFound)
+}
+
+// Search for a file in each of the given request paths (in the mounts and the local filesystem), and
+// respond with the first one found.  The given URL parameters are made available to templates.
+// Returns whether a response was written.
+func (self *Server) tryPaths(w http.ResponseWriter, req *http.Request, requestPaths []string, params map[string]interface{}) bool {
 	var triedLocal bool
 
-PathLoop:
 	// search for the file in all of the generated request paths
 	for _, rPath := range requestPaths {
 		// remove the Route Prefix, as that's a structural part of the path but does not
@@ -989,7 +1386,11 @@ PathLoop:
 		var headers = make(map[string]interface{})
 		var urlParams = make(map[string]interface{})
 
-		if self.TryLocalFirst && !triedLocal {
+		for k, v := range params {
+			urlParams[k] = v
+		}
+
+		if !triedLocal && self.localFirstFor(rPath, req) {
 			triedLocal = true
 
 			// attempt loading the file from the local filesystem before searching the mounts
@@ -1006,7 +1407,7 @@ PathLoop:
 				redirectCode = response.RedirectCode
 
 			} else if IsHardStop(err) {
-				break PathLoop
+				return false
 			}
 		} else {
 			// search the mounts before attempting to load the file from the local filesystem
@@ -1019,7 +1420,7 @@ PathLoop:
 				redirectCode = response.RedirectCode
 
 			} else if IsHardStop(err) {
-				break PathLoop
+				return false
 
 			} else if f, m, err := self.tryLocalFile(rPath, req); err == nil {
 				file = f
@@ -1034,27 +1435,30 @@ PathLoop:
 
 			http.Redirect(w, req, redirectTo, redirectCode)
 			log.Debugf("  path %v redirecting to %v (HTTP %d)", rPath, redirectTo, redirectCode)
-			return
+			return true
 		}
 
 		if file != nil {
 			defer file.Close()
 
+			// streamed responses (e.g.: proxied event streams) are passed on as they are received
+			if response, ok := file.(*MountResponse); ok && response.IsStream() {
+				serveStream(w, response, headers)
+				return true
+			}
+
 			if strings.Contains(rPath, `__id.`) {
 				urlParams[`1`] = strings.Trim(path.Base(req.URL.Path), `/`)
 				urlParams[`id`] = strings.Trim(path.Base(req.URL.Path), `/`)
 			}
 
 			if handled := self.tryToHandleFoundFile(rPath, mimeType, file, statusCode, headers, urlParams, w, req); handled {
-				return
+				return true
 			}
 		}
 	}
 
-	// if we got *here*, then File Not Found
-	// log.Debugf("< not found")
-
-	self.respondError(w, fmt.Errorf("File %q was not found.", requestPath), http.StatusNotFound)
+	return false
 }
 
 // Attempt to resolve the given path into a real file and return that file and mime type.
@@ -1099,7 +1503,7 @@ func (self *Server) tryMounts(requestPath string, req *http.Request) (Mount, *Mo
 	}
 
 	// find a mount that has this file
-	for _, mount := range self.Mounts {
+	for _, mount := range self.sortedMounts() {
 		// seek the body buffer back to the beginning
 		if _, err := body.Seek(0, 0); err != nil {
 			return nil, nil, err
@@ -1108,6 +1512,7 @@ func (self *Server) tryMounts(requestPath string, req *http.Request) (Mount, *Mo
 		if mount.WillRespondTo(requestPath, req, body) {
 			// attempt to open the file entry
 			if mountResponse, err := mount.OpenWithType(requestPath, req, body); err == nil {
+				requestLog(req).Mount = mount.GetMountPoint()
 				return mount, mountResponse, nil
 			} else if IsHardStop(err) {
 				return nil, nil, err
@@ -1120,25 +1525,43 @@ func (self *Server) tryMounts(requestPath string, req *http.Request) (Mount, *Mo
 	return nil, nil, fmt.Errorf("%q not found", requestPath)
 }
 
+// Return the first mount that will respond to the given path and wants to stream the response.
+func (self *Server) streamingMountFor(requestPath string, req *http.Request) StreamingMount {
+	requestPath = strings.TrimPrefix(requestPath, self.RoutePrefix)
+
+	for _, mount := range self.sortedMounts() {
+		if streamer, ok := mount.(StreamingMount); ok {
+			if streamer.WillRespondTo(requestPath, req, nil) && streamer.WillStream(req) {
+				return streamer
+			}
+		}
+	}
+
+	return nil
+}
+
 func (self *Server) tryToHandleFoundFile(requestPath string, mimeType string, file http.File, statusCode int, headers map[string]interface{}, urlParams map[string]interface{}, w http.ResponseWriter, req *http.Request) bool {
 	// add in any metadata as response headers
-	for k, v := range headers {
-		w.Header().Set(k, fmt.Sprintf("%v", v))
-	}
+	setResponseHeaders(w, headers)
 
 	if mimeType == `` {
 		mimeType = fileutil.GetMimeType(requestPath, `application/octet-stream`)
 	}
 
-	// write out the HTTP status if we were given one
-	if statusCode > 0 {
-		w.WriteHeader(statusCode)
-	}
-
 	// we got a real actual file here, figure out if we're templating it or not
 	if self.shouldApplyTemplate(requestPath) {
+		// rendered pages pass through here so that they can be cached (if the page asks to be)
+		writer := &pageCacheWriter{
+			ResponseWriter: w,
+		}
+
+		// write out the HTTP status if we were given one
+		if statusCode > 0 {
+			writer.WriteHeader(statusCode)
+		}
+
 		// tease the template header out of the file
-		if header, templateData, err := SplitTemplateHeaderContent(file); err == nil {
+		if header, templateData, err := self.splitTemplateFile(requestPath, file); err == nil {
 			if header != nil {
 				if redirect := header.Redirect; redirect != nil {
 					w.Header().Set(`Location`, redirect.URL)
@@ -1154,7 +1577,9 @@ func (self *Server) tryToHandleFoundFile(requestPath string, mimeType string, fi
 			}
 
 			// render the final template and write it out
-			if err := self.applyTemplate(w, req, requestPath, bytes.NewBuffer(templateData), header, urlParams, mimeType); err != nil {
+			if err := self.applyTemplate(writer, req, requestPath, bytes.NewBuffer(templateData), header, urlParams, mimeType); err == nil {
+				self.storePage(req, writer)
+			} else {
 				self.respondError(w, err, http.StatusInternalServerError)
 			}
 		} else {
@@ -1164,27 +1589,117 @@ func (self *Server) tryToHandleFoundFile(requestPath string, mimeType string, fi
 		// if not templated, then the file is returned outright
 		if rendererName := httputil.Q(req, `renderer`); rendererName == `` {
 			w.Header().Set(`Content-Type`, mimeType)
-			io.Copy(w, file)
-		} else if renderer, err := GetRenderer(rendererName, self); err == nil {
-			if err := renderer.Render(w, req, RenderOptions{
-				Input: file,
-			}); err != nil {
-				self.respondError(w, err, http.StatusInternalServerError)
+			serveStaticFile(w, req, requestPath, file, statusCode)
+		} else {
+			// write out the HTTP status if we were given one
+			if statusCode > 0 {
+				w.WriteHeader(statusCode)
 			}
-		} else if renderer, ok := GetRendererForFilename(requestPath, self); ok {
-			if err := renderer.Render(w, req, RenderOptions{
-				Input: file,
-			}); err != nil {
-				self.respondError(w, err, http.StatusInternalServerError)
+
+			if renderer, err := GetRenderer(rendererName, self); err == nil {
+				if err := renderer.Render(w, req, RenderOptions{
+					Input: file,
+				}); err != nil {
+					self.respondError(w, err, http.StatusInternalServerError)
+				}
+			} else if renderer, ok := GetRendererForFilename(requestPath, self); ok {
+				if err := renderer.Render(w, req, RenderOptions{
+					Input: file,
+				}); err != nil {
+					self.respondError(w, err, http.StatusInternalServerError)
+				}
+			} else {
+				self.respondError(w, fmt.Errorf("Unknown renderer %q", rendererName), http.StatusBadRequest)
 			}
-		} else {
-			self.respondError(w, fmt.Errorf("Unknown renderer %q", rendererName), http.StatusBadRequest)
 		}
 	}
 
 	return true
 }
 
+// Set the given mount response metadata as headers on the response.
+func setResponseHeaders(w http.ResponseWriter, headers map[string]interface{}) {
+	for k, v := range headers {
+		if values, ok := v.([]string); ok {
+			w.Header().Del(k)
+
+			for _, value := range values {
+				w.Header().Add(k, value)
+			}
+		} else {
+			w.Header().Set(k, fmt.Sprintf("%v", v))
+		}
+	}
+}
+
+// Copy a streamed mount response to the client, flushing each chunk as soon as it is read.
+func serveStream(w http.ResponseWriter, response *MountResponse, headers map[string]interface{}) {
+	setResponseHeaders(w, headers)
+	w.Header().Set(`Content-Type`, response.ContentType)
+
+	if response.StatusCode > 0 {
+		w.WriteHeader(response.StatusCode)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	flusher, _ := w.(http.Flusher)
+
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := response.Read(buf)
+
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("stream: %v", err)
+			}
+
+			return
+		}
+	}
+}
+
+// Write a non-templated file to the response.  Seekable files are served with support for
+// byte-range requests and conditional GETs (via Last-Modified and ETag); everything else is
+// copied to the response as-is.
+func serveStaticFile(w http.ResponseWriter, req *http.Request, requestPath string, file http.File, statusCode int) {
+	if statusCode == 0 || statusCode == http.StatusOK {
+		if stat, err := file.Stat(); err == nil {
+			if _, err := file.Seek(0, io.SeekCurrent); err == nil {
+				modTime := stat.ModTime()
+
+				// only set a strong ETag if one wasn't provided by the mount and we actually
+				// know something about the file
+				if w.Header().Get(`ETag`) == `` && !modTime.IsZero() {
+					w.Header().Set(`ETag`, fmt.Sprintf("\"%x-%x\"", stat.Size(), modTime.UnixNano()))
+				}
+
+				http.ServeContent(w, req, path.Base(requestPath), modTime, file)
+				return
+			}
+		}
+	} else {
+		w.WriteHeader(statusCode)
+	}
+
+	io.Copy(w, file)
+}
+
 func (self *Server) respondError(w http.ResponseWriter, resErr error, code int) {
 	tmpl := NewTemplate(`error`, HtmlEngine)
 
@@ -1205,11 +1720,14 @@ func (self *Server) respondError(w http.ResponseWriter, resErr error, code int)
 	} {
 		if f, err := self.fs.Open(filename); err == nil {
 			if err := tmpl.ParseFrom(f); err == nil {
-				w.Header().Set(`Content-Type`, `text/html`)
+				var output bytes.Buffer
 
-				if err := tmpl.Render(w, map[string]interface{}{
+				if err := tmpl.Render(&output, map[string]interface{}{
 					`error`: resErr.Error(),
 				}, ``); err == nil {
+					w.Header().Set(`Content-Type`, `text/html`)
+					w.WriteHeader(code)
+					w.Write(output.Bytes())
 					return
 				} else {
 					log.Warningf("Error template %v render failed: %v", filename, err)
@@ -1259,11 +1777,15 @@ func (self *Server) InjectIncludes(w io.Writer, header *TemplateHeader) error {
 	}
 
 	if len(includes) > 0 {
-		for name, includePath := range includes {
+		// includes are always injected in the same order so that the assembled template (and its cache
+		// key) is the same every time
+		for _, name := range maputil.StringKeys(includes) {
+			includePath := includes[name]
+
 			if includeFile, err := self.fs.Open(includePath); err == nil {
 				defer includeFile.Close()
 
-				if includeHeader, includeData, err := SplitTemplateHeaderContent(includeFile); err == nil {
+				if includeHeader, includeData, err := self.splitTemplateFile(includePath, includeFile); err == nil {
 					if stat, err := includeFile.Stat(); err == nil {
 						log.Debugf("Injecting included template %q from file %s", name, stat.Name())
 
@@ -1310,57 +1832,143 @@ func (self *Server) setupServer() error {
 	// setup panic recovery handler
 	self.server.Use(negroni.NewRecovery())
 
-	// setup request ID generation
-	self.server.UseHandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		requestId := base58.Encode(stringutil.UUID().Bytes())
+	// setup request ID generation and access logging
+	if err := self.openAccessLog(); err != nil {
+		return err
+	}
+
+	self.server.UseFunc(self.logRequests)
 
-		parent := req.Context()
-		identified := context.WithValue(parent, `diecast-request-id`, requestId)
-		*req = *req.WithContext(identified)
-	})
+	// reject requests that are too large or too frequent
+	if err := self.setupLimits(); err != nil {
+		return err
+	}
+
+	self.server.UseFunc(self.limitRequests)
+
+	// answer CORS preflight requests and add security headers to every response (these do nothing
+	// unless configured, but are always added so that reloading the configuration can enable them)
+	if err := self.setupCors(); err != nil {
+		return err
+	}
+
+	self.server.UseFunc(self.applyCors)
+	self.server.UseFunc(self.addSecurityHeaders)
+
+	// compress responses (this sees the final output, e.g.: after live reload has been injected)
+	if self.Compression.Enabled {
+		self.server.UseFunc(self.compressResponses)
+	}
 
 	// setup internal/metadata routes
 	mux := http.NewServeMux()
 
-	mux.HandleFunc(fmt.Sprintf("%s/_diecast", self.RoutePrefix), func(w http.ResponseWriter, req *http.Request) {
-		defer req.Body.Close()
+	// liveness and readiness probes are always available
+	mux.HandleFunc(self.RoutePrefix+HealthPath, self.serveHealth)
+	mux.HandleFunc(self.RoutePrefix+ReadyPath, self.serveReady)
 
-		if req.Header.Get(`X-Diecast-Binding`) != `` {
-			if data, err := json.Marshal(self); err == nil {
-				w.Header().Set(`Content-Type`, `application/json`)
+	mux.HandleFunc(fmt.Sprintf("%s/_diecast", self.RoutePrefix), self.introspect(func(req *http.Request) interface{} {
+		return self
+	}))
+
+	mux.HandleFunc(fmt.Sprintf("%s/_bindings", self.RoutePrefix), self.introspect(func(req *http.Request) interface{} {
+		return self.Bindings
+	}))
+
+	mux.HandleFunc(fmt.Sprintf("%s/_diecast/upstreams", self.RoutePrefix), self.introspect(func(req *http.Request) interface{} {
+		upstreams := make([]map[string]interface{}, 0)
+
+		for _, mount := range self.Mounts {
+			if proxy, ok := mount.(*ProxyMount); ok {
+				upstreams = append(upstreams, map[string]interface{}{
+					`mount`:     proxy.GetMountPoint(),
+					`balance`:   sliceutil.OrString(proxy.Balance, string(BalanceRoundRobin)),
+					`upstreams`: proxy.UpstreamStatus(),
+				})
+			}
+		}
+
+		return upstreams
+	}))
+
+	mux.HandleFunc(fmt.Sprintf("%s/_diecast/commands", self.RoutePrefix), self.introspect(func(req *http.Request) interface{} {
+		statuses := make([]CommandStatus, 0)
+
+		for _, scmd := range self.commands() {
+			statuses = append(statuses, scmd.Status())
+		}
+
+		return statuses
+	}))
+
+	cacheStats := self.introspect(func(req *http.Request) interface{} {
+		stats := self.TemplateCacheStats()
+		stats[`pages`] = self.PageCacheStats()
+
+		return stats
+	})
+
+	// purging cached pages requires authentication
+	mux.HandleFunc(fmt.Sprintf("%s/_diecast/cache", self.RoutePrefix), func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost, http.MethodDelete:
+			defer req.Body.Close()
 
-				if _, err := w.Write(data); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+			if auth, err := self.Authenticators.Authenticator(req); err == nil {
+				if auth == nil {
+					http.Error(w, `Purging the page cache requires authentication.`, http.StatusForbidden)
+					return
+				} else if !self.authenticate(auth, w, req) {
+					return
 				}
 			} else {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
-		} else {
-			http.Error(w, fmt.Sprintf("File %q was not found.", req.URL.Path), http.StatusNotFound)
-		}
-	})
 
-	mux.HandleFunc(fmt.Sprintf("%s/_bindings", self.RoutePrefix), func(w http.ResponseWriter, req *http.Request) {
-		defer req.Body.Close()
+			purged := self.PurgePages(req.URL.Query().Get(`prefix`), req.URL.Query().Get(`tag`))
+			log.Infof("Purged %d pages from the page cache", purged)
 
-		if req.Header.Get(`X-Diecast-Binding`) != `` {
-			if data, err := json.Marshal(self.Bindings); err == nil {
+			if data, err := json.Marshal(map[string]interface{}{
+				`purged`: purged,
+			}); err == nil {
 				w.Header().Set(`Content-Type`, `application/json`)
-
-				if _, err := w.Write(data); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
+				w.Write(data)
 			} else {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 			}
-		} else {
-			http.Error(w, fmt.Sprintf("File %q was not found.", req.URL.Path), http.StatusNotFound)
+
+		default:
+			cacheStats(w, req)
 		}
 	})
 
+	if err := self.Introspection.Access.Validate(); err != nil {
+		return fmt.Errorf("introspection: %v", err)
+	}
+
+	if self.Metrics.Enabled {
+		if err := self.Metrics.Access.Validate(); err != nil {
+			return fmt.Errorf("metrics: %v", err)
+		}
+
+		mux.HandleFunc(self.RoutePrefix+MetricsPath, self.serveMetrics)
+	}
+
+	// in development mode, browsers are told to reload when files change
+	if self.Watch {
+		if self.liveReload == nil {
+			self.liveReload = newLiveReloadHub()
+		}
+
+		self.server.UseFunc(self.injectLiveReload)
+		mux.HandleFunc(self.RoutePrefix+LiveReloadPath, self.serveLiveReload)
+	}
+
 	// all other routes proxy to this http.Handler
 	mux.HandleFunc(fmt.Sprintf("%s/", self.RoutePrefix), self.handleFileRequest)
 
+	self.mux = mux
 	self.server.UseHandler(mux)
 
 	return nil
@@ -1439,96 +2047,6 @@ func requestToEvalData(req *http.Request, header *TemplateHeader) map[string]int
 	return rv
 }
 
-func (self *Server) RunStartCommand(scmd *StartCommand, waitForCommand bool) error {
-	if cmdline := scmd.Command; cmdline != `` {
-		if tokens, err := shellwords.Parse(cmdline); err == nil {
-			scmd.cmd = exec.Command(tokens[0], tokens[1:]...)
-			scmd.cmd.SysProcAttr = &syscall.SysProcAttr{
-				Setpgid: true,
-			}
-
-			env := make(map[string]interface{})
-
-			for _, pair := range os.Environ() {
-				key, value := stringutil.SplitPair(pair, `=`)
-				env[key] = value
-			}
-
-			for key, value := range scmd.Environment {
-				env[key] = value
-			}
-
-			env[`DIECAST`] = true
-			env[`DIECAST_BIN`] = self.BinPath
-			env[`DIECAST_DEBUG`] = self.EnableDebugging
-			env[`DIECAST_ADDRESS`] = self.Address
-			env[`DIECAST_ROOT`] = self.RootPath
-			env[`DIECAST_PATH_LAYOUTS`] = self.LayoutPath
-			env[`DIECAST_PATH_ERRORS`] = self.ErrorsPath
-			env[`DIECAST_BINDING_PREFIX`] = self.BindingPrefix
-			env[`DIECAST_ROUTE_PREFIX`] = self.RoutePrefix
-
-			for key, value := range env {
-				scmd.cmd.Env = append(scmd.cmd.Env, fmt.Sprintf("%v=%v", key, value))
-			}
-
-			if dir := scmd.Directory; dir != `` {
-				if xdir, err := pathutil.ExpandUser(dir); err == nil {
-					if absdir, err := filepath.Abs(xdir); err == nil {
-						scmd.cmd.Dir = absdir
-					} else {
-						return err
-					}
-				} else {
-					return err
-				}
-			}
-
-			if prewait, err := timeutil.ParseDuration(scmd.WaitBefore); err == nil && prewait > 0 {
-				log.Infof("Waiting %v before running command", prewait)
-				time.Sleep(prewait)
-			}
-
-			if wait, err := timeutil.ParseDuration(scmd.Wait); err == nil {
-				waitchan := make(chan error)
-
-				go func() {
-					log.Infof("Executing command: %v", strings.Join(scmd.cmd.Args, ` `))
-					waitchan <- scmd.cmd.Run()
-				}()
-
-				time.Sleep(wait)
-
-				if waitForCommand {
-					return <-waitchan
-				} else {
-					return nil
-				}
-			} else {
-				return err
-			}
-		} else {
-			return fmt.Errorf("invalid command: %v", err)
-		}
-	} else {
-		return nil
-	}
-}
-
-func (self *Server) cleanupCommands() {
-	if self.PrestartCommand.cmd != nil {
-		if proc := self.PrestartCommand.cmd.Process; proc != nil {
-			proc.Kill()
-		}
-	}
-
-	if self.StartCommand.cmd != nil {
-		if proc := self.StartCommand.cmd.Process; proc != nil {
-			proc.Kill()
-		}
-	}
-}
-
 func appendTemplate(dest io.Writer, src io.Reader, name string, hasLayout bool) error {
 	if hasLayout {
 		dest.Write([]byte("\n{{ define \"" + name + "\" }}\n"))
@@ -0,0 +1,116 @@
+package diecast
+
+import (
+	"context"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/ghetzel/go-stockutil/timeutil"
+)
+
+var DefaultShutdownTimeout = time.Duration(10) * time.Second
+
+// Create an HTTP server that will be stopped when this server is shut down.
+func (self *Server) newHttpServer(address string, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:           address,
+		Handler:        handler,
+		MaxHeaderBytes: self.Limits.MaxHeaderSize,
+	}
+
+	self.httpServersLock.Lock()
+	self.httpServers = append(self.httpServers, srv)
+	self.httpServersLock.Unlock()
+
+	return srv
+}
+
+func (self *Server) shutdownTimeout() time.Duration {
+	if d, err := timeutil.ParseDuration(self.ShutdownTimeout); err == nil && d > 0 {
+		return d
+	}
+
+	return DefaultShutdownTimeout
+}
+
+// Gracefully stop the server: stop accepting new connections, wait for in-flight requests to finish
+// (or for the context to be cancelled), then terminate any prestart and start commands (along with
+// their child processes) and stop upstream health checks.  If the context has no deadline,
+// ShutdownTimeout is used.
+func (self *Server) Shutdown(ctx context.Context) error {
+	var err error
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.shutdownTimeout())
+		defer cancel()
+	}
+
+	self.httpServersLock.Lock()
+	servers := self.httpServers
+	self.httpServers = nil
+	self.httpServersLock.Unlock()
+
+	log.Infof("Shutting down, waiting for in-flight requests to complete")
+
+	// live reload connections stay open indefinitely, so they need to be closed first
+	self.stopWatching()
+
+	for _, srv := range servers {
+		if serr := srv.Shutdown(ctx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	self.cleanupCommands()
+	self.closeMounts()
+
+	return err
+}
+
+// Stop any background work being done by this server's mounts (and those of its sites).
+func (self *Server) closeMounts() {
+	closeMounts(self.Mounts)
+
+	if current := self.current(); current != self {
+		current.closeMounts()
+	}
+
+	for _, site := range self.Sites {
+		if site.server != nil {
+			site.server.closeMounts()
+		}
+	}
+}
+
+// Ask every process in the given process group to exit, forcibly killing them if they're still running
+// after the grace period.
+func terminateProcessGroup(pgid int, grace time.Duration) {
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(grace)
+
+	for time.Now().Before(deadline) {
+		// signal 0 only checks whether anything in the group is still alive
+		if err := syscall.Kill(-pgid, 0); err != nil {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	log.Warningf("Process group %d did not exit within %v, killing", pgid, grace)
+	syscall.Kill(-pgid, syscall.SIGKILL)
+}
+
+func ignoreServerClosed(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,116 @@
+package diecast
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ghetzel/go-stockutil/log"
+)
+
+// A Site is a separately-configured server that responds to requests for one or more hostnames.
+// Hostnames may contain wildcards (e.g.: "*.example.com"); exact matches take precedence.  Each site
+// is configured from an optional config file, followed by any inline options (which take the same
+// form as the top-level configuration).
+type Site struct {
+	Hosts   []string               `json:"hosts"`
+	Root    string                 `json:"root"`
+	Config  string                 `json:"config"`
+	Options map[string]interface{} `json:"options"`
+	server  *Server
+}
+
+// Returns the server handling requests for this site (only available after initialization).
+func (self *Site) Server() *Server {
+	return self.server
+}
+
+func (self *Site) String() string {
+	return fmt.Sprintf("site(%v)", strings.Join(self.Hosts, `, `))
+}
+
+func (self *Server) setupSites() error {
+	for i, site := range self.Sites {
+		if len(site.Hosts) == 0 {
+			return fmt.Errorf("site %d: must specify at least one hostname", i)
+		}
+
+		server := NewServer(self.RootPath)
+		server.Address = self.Address
+		server.metrics = self.metricsRegistry()
+
+		if site.Config != `` {
+			if err := server.LoadConfig(site.Config); err != nil {
+				return fmt.Errorf("%v: %v", site, err)
+			}
+		}
+
+		if len(site.Options) > 0 {
+			if data, err := json.Marshal(site.Options); err == nil {
+				if err := server.loadConfigData(data); err != nil {
+					return fmt.Errorf("%v: %v", site, err)
+				}
+			} else {
+				return fmt.Errorf("%v: %v", site, err)
+			}
+		}
+
+		if site.Root != `` {
+			server.RootPath = site.Root
+		}
+
+		if len(server.Sites) > 0 {
+			return fmt.Errorf("%v: sites cannot be nested", site)
+		}
+
+		if err := server.Initialize(); err != nil {
+			return fmt.Errorf("%v: %v", site, err)
+		}
+
+		site.server = server
+		log.Infof("%v serving %v", site, server.RootPath)
+	}
+
+	return nil
+}
+
+// Return the site that should handle the given request, or nil if the request should be handled by
+// this server.
+func (self *Server) siteFor(req *http.Request) *Site {
+	if len(self.Sites) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(req.Host)
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(host, `.`)
+
+	// exact hostnames win over wildcards
+	for _, wildcards := range []bool{false, true} {
+		for _, site := range self.Sites {
+			if site.server == nil {
+				continue
+			}
+
+			for _, pattern := range site.Hosts {
+				pattern = strings.ToLower(pattern)
+
+				if isWildcard := strings.ContainsAny(pattern, `*?[{`); isWildcard != wildcards {
+					continue
+				} else if isWildcard && headerGlobMatch(pattern, host) {
+					return site
+				} else if !isWildcard && pattern == host {
+					return site
+				}
+			}
+		}
+	}
+
+	return nil
+}
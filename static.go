@@ -192,18 +192,19 @@ var _escData = map[string]*_escFile{
 
 	"/autoindex.html": {
 		local:   "ui/autoindex.html",
-		size:    1862,
+		size:    2080,
 		modtime: 1500000000,
 		compressed: `
-H4sIAAAAAAAC/8xVzW7bMAy+9ykIowUSYLGSnIZM9oBhlx26y/oAViI61mBbmsShcwW/+yA7S+L8NQhW
-oLpY1Ed9pD4SNC+oKtM7AABeoJD9tjMdNSUCNQaTiPAPsZVz0Q4PK1z+AEstG/ADIKxc1zTJRaXKZgGV
-rrUzYoWfBn7t3cCk4gRPiD0RpVrXCygxp4sMsVMv+AqJVevigCUsI6RU9XrSwQuYY3UYaSsN67TZyMZ2
-uvEgxU4i7+HewCKB0S8HmcnAPMsxtHsp82KW9l5ty1kxS/chC2zfJrEsEZ6VpCKJZtPpw0ExOA0LuDu3
-x4ebC+l3USFnVJz3eGrMZQ9YlcK5JArKR+kP9fIK4aOWKlcoT3txdphu8Dt6GKeh1Fc8Vp4GOlBAYTFP
-os8m8R6ksrWosC9LlMYxZ+IMKztHG+JdRIey3ULUSzU49h6sqNcIuSoJLYyksnBvxpDF39xXZbPQfW+i
-mRFU/NSqDqLFoas66bzfGjdq6D2oHPrsoW2lsrgibRvvAUsXiL2HSlUYBtU2WEBr2UX9TyXwHkhVCPGj
-lk9hk9l89XE+z84GOe7kbVZX1qzWBLfWbaD8+xA4PJSsqmC0+YjfpJcNIcRhakD0EM/yaAzZlyw07DS7
-Jvc3KgpnBwOGs27+/pv5PchZ//v8GwAA///dWBwIRgcAAA==
+H4sIAAAAAAAC/6xWzW7bPBC85ykGwpcPDdCIcU6FQ6lA0UsO6aV5ADHiyiKgH5fcolEEvXtBy4l+Ijtu
+2pPF3eWsZnZEWuZcFvEZAMiclO4fAUCy4YLi20rTI+oMbYv/QvWTa+Mj4VZxjq6Toi8btjluCgI3W4oC
+pkcWqXPBkAcA3/MjHmrdoJ0kACCrK77MVGmKZo2yrmq3VSndTOq6s8mS8wUc3/tSFWZTrVFQxkcRQmee
+6A0QazY537wq2SqtTbW53KXXuKZy3gkAAECKnTZ7tcUgt/RSxC91XunaarJYR0iUSxN03ThrMtCPyTT6
+8ufaASBCouklSJX2SMML5au355uv4vEOCzFes3ooCL+M5jwKVldX57NRS566aojb18H9hlgq5JayKPjs
+astRpUr6f8cnGph1XRB/UyVJoWIpOD+Mdt9s6WgF0kI5FwXeA8G8uQ8uNv9unk5oPkMra20yQ3oR8W6f
+PIwqxVw2KRYEljw11GCb6YQtVTy21gnD0csJAHih2rbLfYI4DD23ZWjB+nDTo9nZ/N4B9FrXha9lH7aq
+2tCEIFVsDbmTlexHEd66r8YubfojpUP/EaDrRBCPV+/UWRtLKde2+WvBvYCFo3/Gb0LvnezaFqUpyd9N
+I6iTifrhszUlPux/vAUeGiaE/jBAcB6usuACyZfkAkl4lRyEH9x15FXZlITwrtb3/iGxWfrp+vow5jEP
+z+qmp4MUu0P8+Vrqk1L0fwx+DwAg7VA4IAgAAA==
 `,
 	},
 
@@ -161,6 +161,14 @@ func (self *Template) preprocessTemplate() error {
 
 func (self *Template) Funcs(funcs FuncMap) {
 	self.funcs = funcs
+
+	// functions can be replaced after parsing, so that a parsed template can be reused between requests
+	switch t := self.tmpl.(type) {
+	case *text.Template:
+		t.Funcs(text.FuncMap(funcs))
+	case *html.Template:
+		t.Funcs(html.FuncMap(funcs))
+	}
 }
 
 func (self *Template) prepareError(err error) error {
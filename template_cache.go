@@ -0,0 +1,284 @@
+package diecast
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The default number of template files and parsed templates to keep in memory.
+var DefaultTemplateCacheSize = 512
+
+type CacheStats struct {
+	Entries  int   `json:"entries"`
+	Capacity int   `json:"capacity"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Stale    int64 `json:"stale,omitempty"`
+}
+
+// A size-bounded, least-recently-used cache.
+type lruCache struct {
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	hits     int64
+	misses   int64
+	lock     sync.Mutex
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLruCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (self *lruCache) Get(key string) (interface{}, bool) {
+	return self.GetIf(key, nil)
+}
+
+// Retrieve the value for the given key, but only if it is still valid (according to the given
+// function); invalid values are counted as misses.
+func (self *lruCache) GetIf(key string, valid func(value interface{}) bool) (interface{}, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if el, ok := self.entries[key]; ok {
+		if value := el.Value.(*lruEntry).value; valid == nil || valid(value) {
+			self.order.MoveToFront(el)
+			self.hits++
+			return value, true
+		}
+	}
+
+	self.misses++
+	return nil, false
+}
+
+// Remove all entries for which the given function returns true, returning how many were removed.
+func (self *lruCache) RemoveIf(fn func(key string, value interface{}) bool) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	var removed int
+
+	for key, el := range self.entries {
+		if fn(key, el.Value.(*lruEntry).value) {
+			self.order.Remove(el)
+			delete(self.entries, key)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+func (self *lruCache) Set(key string, value interface{}) {
+	if self.capacity <= 0 {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if el, ok := self.entries[key]; ok {
+		el.Value.(*lruEntry).value = value
+		self.order.MoveToFront(el)
+		return
+	}
+
+	self.entries[key] = self.order.PushFront(&lruEntry{
+		key:   key,
+		value: value,
+	})
+
+	for self.order.Len() > self.capacity {
+		oldest := self.order.Back()
+		self.order.Remove(oldest)
+		delete(self.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (self *lruCache) Stats() CacheStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return CacheStats{
+		Entries:  self.order.Len(),
+		Capacity: self.capacity,
+		Hits:     self.hits,
+		Misses:   self.misses,
+	}
+}
+
+type cachedTemplateFile struct {
+	header  *TemplateHeader
+	data    []byte
+	modTime time.Time
+	size    int64
+}
+
+func (self *Server) initTemplateCaches() {
+	self.templateCacheInit.Do(func() {
+		size := self.TemplateCacheSize
+
+		if size == 0 {
+			size = DefaultTemplateCacheSize
+		}
+
+		self.fileCache = newLruCache(size)
+		self.templateCache = newLruCache(size)
+	})
+}
+
+// Returns statistics for the cache of template files (with their headers already parsed) and the
+// cache of compiled templates.
+func (self *Server) TemplateCacheStats() map[string]CacheStats {
+	self.initTemplateCaches()
+
+	return map[string]CacheStats{
+		`files`:     self.fileCache.Stats(),
+		`templates`: self.templateCache.Stats(),
+	}
+}
+
+// Split the given file into its header and template content, reusing the result from a previous call
+// if the file (identified by key) has not been modified since.
+func (self *Server) splitTemplateFile(key string, file http.File) (*TemplateHeader, []byte, error) {
+	self.initTemplateCaches()
+
+	stat, err := file.Stat()
+
+	if err != nil || stat.ModTime().IsZero() {
+		return SplitTemplateHeaderContent(file)
+	}
+
+	if value, ok := self.fileCache.GetIf(key, func(value interface{}) bool {
+		cached := value.(*cachedTemplateFile)
+		return cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size()
+	}); ok {
+		cached := value.(*cachedTemplateFile)
+		return copyHeader(cached.header), cached.data, nil
+	}
+
+	header, data, err := SplitTemplateHeaderContent(file)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	self.fileCache.Set(key, &cachedTemplateFile{
+		header:  header,
+		data:    data,
+		modTime: stat.ModTime(),
+		size:    stat.Size(),
+	})
+
+	return copyHeader(header), data, nil
+}
+
+// Open and split a template file from the root filesystem (see splitTemplateFile).
+func (self *Server) loadTemplateFile(name string) (*TemplateHeader, []byte, error) {
+	if file, err := self.fs.Open(name); err == nil {
+		defer file.Close()
+		return self.splitTemplateFile(name, file)
+	} else {
+		return nil, nil, err
+	}
+}
+
+// headers are modified while templates are assembled, so cached headers are never handed out directly
+func copyHeader(header *TemplateHeader) *TemplateHeader {
+	if header == nil {
+		return nil
+	}
+
+	dup := *header
+	return &dup
+}
+
+// Parsed copies of the same template.  A template can only be executed by one request at a time (each
+// request brings its own functions), so idle copies are kept here to be reused by later requests.
+type templatePool struct {
+	idle []*Template
+	lock sync.Mutex
+}
+
+// The maximum number of idle copies kept for each template.
+var maxIdleTemplates = 8
+
+func (self *templatePool) get() *Template {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if n := len(self.idle); n > 0 {
+		tmpl := self.idle[n-1]
+		self.idle = self.idle[:n-1]
+		return tmpl
+	}
+
+	return nil
+}
+
+func (self *templatePool) put(tmpl *Template) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.idle) < maxIdleTemplates {
+		self.idle = append(self.idle, tmpl)
+	}
+}
+
+// Return a parsed template for the given input, parsing it only if the same input hasn't been parsed
+// before.  Since the input includes the text of all layouts and includes, a change to any of them
+// produces a different template.  The returned function must be called once the template has been
+// rendered, which makes it available to the next request.
+func (self *Server) parsedTemplate(name string, engine Engine, funcs FuncMap, headerOffset int, input string) (*Template, func(), error) {
+	self.initTemplateCaches()
+
+	hash := sha1.Sum([]byte(input))
+	key := fmt.Sprintf("%v:%v:%s", engine, name, hex.EncodeToString(hash[:]))
+	var pool *templatePool
+
+	if value, ok := self.templateCache.Get(key); ok {
+		pool = value.(*templatePool)
+
+		if tmpl := pool.get(); tmpl != nil {
+			tmpl.Funcs(funcs)
+			tmpl.SetHeaderOffset(headerOffset)
+			tmpl.postprocessors = nil
+
+			return tmpl, func() { pool.put(tmpl) }, nil
+		}
+	}
+
+	tmpl := NewTemplate(name, engine)
+	tmpl.Funcs(funcs)
+	tmpl.SetHeaderOffset(headerOffset)
+
+	started := time.Now()
+
+	if err := tmpl.Parse(input); err != nil {
+		return nil, nil, err
+	}
+
+	self.metricsRegistry().templateParse.Observe(time.Since(started), engine.String())
+
+	if pool == nil {
+		pool = new(templatePool)
+		self.templateCache.Set(key, pool)
+	}
+
+	return tmpl, func() { pool.put(tmpl) }, nil
+}
@@ -0,0 +1,239 @@
+package diecast
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/log"
+)
+
+var TlsReloadCheckInterval = time.Second
+var SelfSignedCertificateLifetime = 365 * 24 * time.Hour
+
+type TlsConfig struct {
+	Cert            string   `json:"cert"`       // path to a PEM-encoded certificate (chain)
+	Key             string   `json:"key"`        // path to the PEM-encoded private key for the certificate
+	SelfSigned      bool     `json:"selfSigned"` // generate a self-signed certificate (for development)
+	MinVersion      string   `json:"minVersion"` // one of "1.0", "1.1", "1.2", or "1.3"
+	Ciphers         []string `json:"ciphers"`    // cipher suite names (as defined by crypto/tls); TLS 1.3 suites are not configurable
+	DisableHTTP2    bool     `json:"disableHttp2"`
+	RedirectAddress string   `json:"redirect"` // if set, listen here for plain HTTP requests and redirect them to HTTPS
+}
+
+func (self *TlsConfig) Enabled() bool {
+	return self != nil && (self.SelfSigned || (self.Cert != `` && self.Key != ``))
+}
+
+// Build a tls.Config from the given configuration.  Certificates loaded from files are reloaded
+// when either file changes.
+func (self *TlsConfig) tlsConfig(hosts ...string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if self.MinVersion != `` {
+		switch strings.TrimPrefix(strings.ToLower(self.MinVersion), `tls`) {
+		case `1.0`, `10`:
+			config.MinVersion = tls.VersionTLS10
+		case `1.1`, `11`:
+			config.MinVersion = tls.VersionTLS11
+		case `1.2`, `12`:
+			config.MinVersion = tls.VersionTLS12
+		case `1.3`, `13`:
+			config.MinVersion = tls.VersionTLS13
+		default:
+			return nil, fmt.Errorf("invalid TLS minimum version %q", self.MinVersion)
+		}
+	}
+
+	for _, name := range self.Ciphers {
+		if id, ok := cipherSuiteByName(name); ok {
+			config.CipherSuites = append(config.CipherSuites, id)
+		} else {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+	}
+
+	if self.Cert != `` && self.Key != `` {
+		loader := &certificateLoader{
+			CertFile: self.Cert,
+			KeyFile:  self.Key,
+		}
+
+		if err := loader.load(); err != nil {
+			return nil, err
+		}
+
+		config.GetCertificate = loader.GetCertificate
+	} else if self.SelfSigned {
+		if cert, err := generateSelfSignedCertificate(hosts...); err == nil {
+			log.Warningf("Using a self-signed certificate for %v; this should only be used for development.", strings.Join(hosts, `, `))
+			config.Certificates = []tls.Certificate{*cert}
+		} else {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("must specify a certificate and key, or enable self-signed mode")
+	}
+
+	if self.DisableHTTP2 {
+		config.NextProtos = []string{`http/1.1`}
+	} else {
+		config.NextProtos = []string{`h2`, `http/1.1`}
+	}
+
+	return config, nil
+}
+
+func cipherSuiteByName(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if strings.EqualFold(suite.Name, name) {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// Loads a certificate and key from disk, reloading them whenever either file is modified.
+type certificateLoader struct {
+	CertFile  string
+	KeyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	lock      sync.RWMutex
+}
+
+func (self *certificateLoader) filesModTime() time.Time {
+	var latest time.Time
+
+	for _, filename := range []string{self.CertFile, self.KeyFile} {
+		if stat, err := os.Stat(filename); err == nil && stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+
+	return latest
+}
+
+func (self *certificateLoader) load() error {
+	modTime := self.filesModTime()
+
+	if cert, err := tls.LoadX509KeyPair(self.CertFile, self.KeyFile); err == nil {
+		self.lock.Lock()
+		self.cert = &cert
+		self.modTime = modTime
+		self.lock.Unlock()
+
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (self *certificateLoader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.lock.RLock()
+	shouldCheck := time.Since(self.lastCheck) >= TlsReloadCheckInterval
+	self.lock.RUnlock()
+
+	if shouldCheck {
+		self.lock.Lock()
+		self.lastCheck = time.Now()
+		changed := self.filesModTime().After(self.modTime)
+		self.lock.Unlock()
+
+		if changed {
+			// if the new files are broken (or only half-written), keep serving the old certificate
+			if err := self.load(); err == nil {
+				log.Infof("Reloaded TLS certificate from %v", self.CertFile)
+			} else {
+				log.Warningf("Failed to reload TLS certificate: %v", err)
+			}
+		}
+	}
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	return self.cert, nil
+}
+
+func generateSelfSignedCertificate(hosts ...string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{`Diecast Development`},
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SelfSignedCertificateLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range append([]string{`localhost`, `127.0.0.1`, `::1`}, hosts...) {
+		if host == `` {
+			continue
+		} else if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// Returns a handler that redirects all requests to the same URL on the HTTPS listener at the given
+// address.
+func httpsRedirectHandler(tlsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddress)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != `` && port != `443` {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, req, `https://`+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
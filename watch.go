@@ -0,0 +1,525 @@
+package diecast
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"github.com/ghetzel/go-stockutil/sliceutil"
+	"github.com/ghodss/yaml"
+)
+
+var DefaultWatchInterval = 500 * time.Millisecond
+
+// Configuration keys that are only read when the server starts.  Reloading a configuration that changes
+// any of these is refused, since doing so would leave the running listeners and commands behind.
+var RestartConfigKeys = []string{
+	`root`,
+	`address`,
+	`listeners`,
+	`tls`,
+	`socketMode`,
+	`socketOwner`,
+	`shutdownTimeout`,
+	`accessLog`,
+	`watch`,
+	`sites`,
+	`prestart`,
+	`start`,
+}
+var LiveReloadPath = `/_diecast/livereload`
+
+// Changes to files with these extensions only reload stylesheets instead of the whole page.
+var LiveReloadStylesheetExtensions = []string{`.css`, `.scss`, `.sass`}
+
+// Injected into HTML responses while watching for changes.  It listens for reload events sent by the
+// server, either reloading the page or just its stylesheets.
+var LiveReloadScript = `<script>(function(){` +
+	`var es = new EventSource(%q);` +
+	`es.addEventListener("reload", function(){ window.location.reload(); });` +
+	`es.addEventListener("css", function(){` +
+	`document.querySelectorAll('link[rel="stylesheet"]').forEach(function(link){` +
+	`var u = new URL(link.href); u.searchParams.set("livereload", Date.now()); link.href = u.toString();` +
+	`});` +
+	`});` +
+	`})();</script>`
+
+var rxClosingBody = regexp.MustCompile(`(?i)</body>`)
+
+// Tracks the clients waiting for reload events.
+type liveReloadHub struct {
+	clients map[chan string]bool
+	closed  bool
+	lock    sync.Mutex
+}
+
+func newLiveReloadHub() *liveReloadHub {
+	return &liveReloadHub{
+		clients: make(map[chan string]bool),
+	}
+}
+
+func (self *liveReloadHub) subscribe() chan string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	events := make(chan string, 8)
+
+	if self.closed {
+		close(events)
+	} else {
+		self.clients[events] = true
+	}
+
+	return events
+}
+
+func (self *liveReloadHub) unsubscribe(events chan string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, ok := self.clients[events]; ok {
+		delete(self.clients, events)
+		close(events)
+	}
+}
+
+func (self *liveReloadHub) broadcast(event string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for events := range self.clients {
+		select {
+		case events <- event:
+		default:
+			// this client is not keeping up; it will get the next one
+		}
+	}
+}
+
+// Disconnect all clients (so that the server can shut down).
+func (self *liveReloadHub) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for events := range self.clients {
+		delete(self.clients, events)
+		close(events)
+	}
+
+	self.closed = true
+}
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// Polls files beneath a set of paths, reporting which ones were created, modified, or deleted since the
+// last check.  Hidden directories (e.g.: ".git") and "node_modules" are skipped.
+type fileWatcher struct {
+	Paths []string
+	files map[string]watchedFile
+}
+
+func (self *fileWatcher) scan() map[string]watchedFile {
+	files := make(map[string]watchedFile)
+
+	for _, root := range self.Paths {
+		filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			if info.IsDir() {
+				if name != root && (strings.HasPrefix(info.Name(), `.`) || info.Name() == `node_modules`) {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			files[name] = watchedFile{
+				modTime: info.ModTime(),
+				size:    info.Size(),
+			}
+
+			return nil
+		})
+	}
+
+	return files
+}
+
+// Return the files that have changed since the last call.  The first call only records the current
+// state of the files.
+func (self *fileWatcher) changes() []string {
+	current := self.scan()
+	changed := make([]string, 0)
+
+	if self.files != nil {
+		for name, file := range current {
+			if previous, ok := self.files[name]; !ok || previous != file {
+				changed = append(changed, name)
+			}
+		}
+
+		for name := range self.files {
+			if _, ok := current[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+	}
+
+	self.files = current
+	return changed
+}
+
+// Return the directories and files that are watched for changes: the root path (which contains
+// layouts, includes, and error pages), local directories mounted by file mounts, and the config file.
+func (self *Server) watchPaths() []string {
+	paths := []string{self.RootPath}
+
+	for _, mount := range self.Mounts {
+		if fileMount, ok := mount.(*FileMount); ok && fileMount.FileSystem == nil {
+			if abs, err := filepath.Abs(fileMount.Path); err == nil && !sliceutil.ContainsString(paths, abs) {
+				paths = append(paths, abs)
+			}
+		}
+	}
+
+	if self.configFile != `` {
+		paths = append(paths, self.configFile)
+	}
+
+	return paths
+}
+
+// Watch for changes to files until the server is shut down, notifying browsers when they occur.
+func (self *Server) startWatching() {
+	self.watchStop = make(chan struct{})
+	watcher := &fileWatcher{
+		Paths: self.watchPaths(),
+	}
+
+	watcher.changes()
+
+	log.Infof("Watching %v for changes", strings.Join(watcher.Paths, `, `))
+
+	go func() {
+		ticker := time.NewTicker(DefaultWatchInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-self.watchStop:
+				return
+			case <-ticker.C:
+				if changed := watcher.changes(); len(changed) > 0 {
+					self.filesChanged(changed)
+					watcher.Paths = self.current().watchPaths()
+				}
+			}
+		}
+	}()
+}
+
+func (self *Server) stopWatching() {
+	if self.watchStop == nil {
+		return
+	}
+
+	self.watchStopOnce.Do(func() {
+		close(self.watchStop)
+
+		if self.liveReload != nil {
+			self.liveReload.close()
+		}
+	})
+}
+
+// Respond to changed files: reload the configuration (if it changed), then tell browsers to reload the
+// page (or just its stylesheets if those are all that changed).
+func (self *Server) filesChanged(changed []string) {
+	event := `css`
+
+	for _, name := range changed {
+		if name == self.configFile {
+			log.Infof("Configuration changed, reloading %v", self.configFile)
+
+			if err := self.reloadConfig(); err != nil {
+				log.Errorf("Failed to reload configuration: %v", err)
+			}
+		}
+
+		if !sliceutil.ContainsString(LiveReloadStylesheetExtensions, strings.ToLower(filepath.Ext(name))) {
+			event = `reload`
+		}
+	}
+
+	log.Infof("Files changed: %v", strings.Join(changed, `, `))
+
+	if self.liveReload != nil {
+		self.liveReload.broadcast(event)
+	}
+}
+
+// Re-read the configuration file into a new server, and once it has been set up, hand requests to it.
+// If anything is wrong with the new configuration, the current one is kept.  Keys that are removed from
+// the file go back to the values they had before the file was first loaded.
+func (self *Server) reloadConfig() error {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	current := self.current()
+	data, err := ioutil.ReadFile(self.configFile)
+
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	for _, key := range RestartConfigKeys {
+		if !reflect.DeepEqual(values[key], current.configValues[key]) {
+			return fmt.Errorf("changes to %q require a restart", key)
+		}
+	}
+
+	next := current.reloadInto(self)
+	next.recordConfigDefaults(values)
+
+	for key := range current.configValues {
+		next.resetConfigKey(key)
+	}
+
+	for key := range values {
+		next.resetConfigKey(key)
+	}
+
+	if err := next.loadConfigData(data); err != nil {
+		closeMounts(next.configMounts)
+		return err
+	}
+
+	// these were checked above, but are put back so the new server shares the running ones
+	for _, key := range RestartConfigKeys {
+		if key != `prestart` && key != `start` {
+			if field, ok := next.configField(key); ok {
+				currentField, _ := current.configField(key)
+				field.Set(currentField)
+			}
+		}
+	}
+
+	if err := next.Initialize(); err != nil {
+		closeMounts(next.configMounts)
+		return err
+	}
+
+	self.reloaded.Store(next)
+	closeMounts(current.configMounts)
+
+	return nil
+}
+
+// Return a new server with this server's settings and mounts (other than those created by the
+// configuration file), sharing the given host's live reload clients, access log, and metrics.
+func (self *Server) reloadInto(host *Server) *Server {
+	next := NewServer(self.RootPath)
+	from := reflect.ValueOf(self).Elem()
+	to := reflect.ValueOf(next).Elem()
+
+	for i := 0; i < from.NumField(); i++ {
+		switch field := from.Type().Field(i); field.Name {
+		case `PrestartCommand`, `StartCommands`:
+			continue
+		default:
+			if field.PkgPath == `` {
+				to.Field(i).Set(from.Field(i))
+			}
+		}
+	}
+
+	next.Mounts = make([]Mount, 0)
+
+	for _, mount := range self.Mounts {
+		if !isConfigMount(self.configMounts, mount) {
+			next.Mounts = append(next.Mounts, mount)
+		}
+	}
+
+	next.host = host
+	next.fs = self.fs
+	next.fsIsSet = self.fsIsSet
+	next.configFile = self.configFile
+	next.configDefaults = self.configDefaults
+	next.configValues = self.configValues
+	next.liveReload = host.liveReload
+	next.accessLog = host.accessLog
+	next.metrics = host.metricsRegistry()
+
+	return next
+}
+
+// Put the given configuration key back to what it was before a configuration file first set it.
+func (self *Server) resetConfigKey(key string) {
+	if data, ok := self.configDefaults[key]; ok {
+		if field, ok := self.configField(key); ok {
+			field.Set(reflect.Zero(field.Type()))
+
+			if err := json.Unmarshal(data, field.Addr().Interface()); err != nil {
+				log.Warningf("config: failed to reset %q: %v", key, err)
+			}
+		}
+	}
+}
+
+// Return the server holding the most recently loaded configuration: this one, or the one that the
+// configuration was last reloaded into.
+func (self *Server) current() *Server {
+	if reloaded, ok := self.reloaded.Load().(*Server); ok {
+		return reloaded
+	}
+
+	return self
+}
+
+// Send reload events to the browser as server-sent events.
+func (self *Server) serveLiveReload(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok || self.liveReload == nil {
+		http.Error(w, `Live reload is not available`, http.StatusInternalServerError)
+		return
+	}
+
+	events := self.liveReload.subscribe()
+	defer self.liveReload.unsubscribe(events)
+
+	w.Header().Set(`Content-Type`, `text/event-stream`)
+	w.Header().Set(`Cache-Control`, `no-cache`)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %d\n\n", event, time.Now().UnixNano())
+			flusher.Flush()
+		}
+	}
+}
+
+// Middleware that adds the live reload client to HTML responses.
+func (self *Server) injectLiveReload(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if req.Method != `GET` || req.URL.Path == self.RoutePrefix+LiveReloadPath || req.Header.Get(`Upgrade`) != `` {
+		next(w, req)
+		return
+	}
+
+	injector := &liveReloadWriter{
+		ResponseWriter: w,
+		script:         fmt.Sprintf(LiveReloadScript, self.RoutePrefix+LiveReloadPath),
+	}
+
+	next(injector, req)
+	injector.finish()
+}
+
+// Buffers HTML responses so that the live reload client can be inserted before the closing </body>
+// tag.  All other responses are passed through untouched.
+type liveReloadWriter struct {
+	http.ResponseWriter
+	script      string
+	status      int
+	wroteHeader bool
+	buffering   bool
+	buffer      bytes.Buffer
+}
+
+func (self *liveReloadWriter) WriteHeader(status int) {
+	if self.wroteHeader {
+		return
+	}
+
+	self.wroteHeader = true
+	self.status = status
+
+	if strings.HasPrefix(self.Header().Get(`Content-Type`), `text/html`) && self.Header().Get(`Content-Encoding`) == `` {
+		self.buffering = true
+	} else {
+		self.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (self *liveReloadWriter) Write(p []byte) (int, error) {
+	if !self.wroteHeader {
+		if self.Header().Get(`Content-Type`) == `` {
+			self.Header().Set(`Content-Type`, http.DetectContentType(p))
+		}
+
+		self.WriteHeader(http.StatusOK)
+	}
+
+	if self.buffering {
+		return self.buffer.Write(p)
+	}
+
+	return self.ResponseWriter.Write(p)
+}
+
+func (self *liveReloadWriter) Flush() {
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok && !self.buffering {
+		flusher.Flush()
+	}
+}
+
+func (self *liveReloadWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := self.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+
+	return nil, nil, fmt.Errorf("%T does not support hijacking", self.ResponseWriter)
+}
+
+func (self *liveReloadWriter) finish() {
+	if !self.buffering {
+		return
+	}
+
+	body := self.buffer.Bytes()
+
+	if loc := rxClosingBody.FindAllIndex(body, -1); len(loc) > 0 {
+		last := loc[len(loc)-1][0]
+		body = append(body[:last:last], append([]byte(self.script), body[last:]...)...)
+	} else {
+		body = append(body, []byte(self.script)...)
+	}
+
+	self.Header().Set(`Content-Length`, fmt.Sprintf("%d", len(body)))
+	self.ResponseWriter.WriteHeader(self.status)
+	self.ResponseWriter.Write(body)
+}
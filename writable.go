@@ -0,0 +1,361 @@
+package diecast
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ghetzel/go-stockutil/log"
+	"golang.org/x/net/webdav"
+)
+
+var DefaultMaxWriteSize int64 = 33554432 // 32 MiB
+
+// HTTP methods that are handled by writable mounts (and the root filesystem, if writable).
+var WritableMethods = []string{
+	`PUT`,
+	`DELETE`,
+	`MKCOL`,
+	`COPY`,
+	`MOVE`,
+	`PROPFIND`,
+	`PROPPATCH`,
+	`LOCK`,
+	`UNLOCK`,
+}
+
+var davLockSystems sync.Map
+
+// A directory on the local filesystem that accepts writes.
+type writableTarget struct {
+	Root    string
+	Prefix  string
+	MaxSize int64
+}
+
+func isWritableMethod(method string) bool {
+	for _, m := range WritableMethods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the writable location that the given request path resolves to (if any).  Writable file
+// mounts are consulted first, followed by the root filesystem.
+func (self *Server) writableTargetFor(requestPath string, req *http.Request) *writableTarget {
+	requestPath = strings.TrimPrefix(requestPath, self.RoutePrefix)
+
+	for _, mount := range self.sortedMounts() {
+		if fileMount, ok := mount.(*FileMount); ok && fileMount.Writable && fileMount.FileSystem == nil {
+			if fileMount.WillRespondTo(requestPath, req, nil) {
+				return &writableTarget{
+					Root:    fileMount.Path,
+					Prefix:  self.RoutePrefix + strings.TrimSuffix(fileMount.basePath(fileMount.MountPoint, requestPath), `/`),
+					MaxSize: fileMount.MaxWriteSize,
+				}
+			}
+		}
+	}
+
+	if self.Writable {
+		return &writableTarget{
+			Root:    self.RootPath,
+			Prefix:  self.RoutePrefix,
+			MaxSize: self.MaxWriteSize,
+		}
+	}
+
+	return nil
+}
+
+// Resolve the given request path to an absolute path inside of the target root, or return an
+// error if the path would escape it.
+func (self *writableTarget) resolve(requestPath string) (string, error) {
+	return self.resolveName(strings.TrimPrefix(requestPath, self.Prefix))
+}
+
+// Resolve the given path (relative to the target root) to an absolute path inside of the root, or
+// return an error if the path would escape it, either lexically or by way of a symbolic link.
+func (self *writableTarget) resolveName(name string) (string, error) {
+	rel := path.Clean(`/` + name)
+
+	abs, err := filepath.Abs(filepath.Join(self.Root, filepath.FromSlash(rel)))
+
+	if err != nil {
+		return ``, err
+	}
+
+	root, err := filepath.Abs(self.Root)
+
+	if err != nil {
+		return ``, err
+	}
+
+	if abs == root {
+		return abs, nil
+	} else if !isWithinPath(root, abs) {
+		return ``, fmt.Errorf("path %q is outside of the writable root", name)
+	}
+
+	// the directory being written to must still be inside the root once symlinks are followed
+	if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+		if realParent, err := evalExistingSymlinks(filepath.Dir(abs)); err == nil {
+			if realParent != realRoot && !isWithinPath(realRoot, realParent) {
+				return ``, fmt.Errorf("path %q is outside of the writable root", name)
+			}
+		} else {
+			return ``, err
+		}
+	} else {
+		return ``, err
+	}
+
+	return abs, nil
+}
+
+func isWithinPath(root string, name string) bool {
+	return strings.HasPrefix(name, root+string(filepath.Separator))
+}
+
+// Like filepath.EvalSymlinks, but for paths that may not exist yet: the deepest existing ancestor
+// is resolved, and the rest of the path is appended to it.
+func evalExistingSymlinks(name string) (string, error) {
+	if real, err := filepath.EvalSymlinks(name); err == nil {
+		return real, nil
+	} else if !os.IsNotExist(err) {
+		return ``, err
+	} else if _, lerr := os.Lstat(name); lerr == nil {
+		// a dangling symlink could point anywhere once its target is created
+		return ``, err
+	} else if parent := filepath.Dir(name); parent != name {
+		if real, err := evalExistingSymlinks(parent); err == nil {
+			return filepath.Join(real, filepath.Base(name)), nil
+		} else {
+			return ``, err
+		}
+	} else {
+		return ``, err
+	}
+}
+
+// A WebDAV filesystem that refuses to operate on paths outside of the writable root.
+type writableFileSystem struct {
+	webdav.Dir
+	target *writableTarget
+}
+
+func (self writableFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := self.target.resolveName(name); err != nil {
+		return err
+	}
+
+	return self.Dir.Mkdir(ctx, name, perm)
+}
+
+func (self writableFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if _, err := self.target.resolveName(name); err != nil {
+		return nil, err
+	}
+
+	return self.Dir.OpenFile(ctx, name, flag, perm)
+}
+
+func (self writableFileSystem) RemoveAll(ctx context.Context, name string) error {
+	if _, err := self.target.resolveName(name); err != nil {
+		return err
+	}
+
+	return self.Dir.RemoveAll(ctx, name)
+}
+
+func (self writableFileSystem) Rename(ctx context.Context, oldName string, newName string) error {
+	if _, err := self.target.resolveName(oldName); err != nil {
+		return err
+	} else if _, err := self.target.resolveName(newName); err != nil {
+		return err
+	}
+
+	return self.Dir.Rename(ctx, oldName, newName)
+}
+
+func (self writableFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if _, err := self.target.resolveName(name); err != nil {
+		return nil, err
+	}
+
+	return self.Dir.Stat(ctx, name)
+}
+
+func (self *writableTarget) maxSize() int64 {
+	if self.MaxSize > 0 {
+		return self.MaxSize
+	} else {
+		return DefaultMaxWriteSize
+	}
+}
+
+func (self *Server) handleWriteRequest(w http.ResponseWriter, req *http.Request, target *writableTarget) {
+	log.Infof("  writable %v %v (root: %v)", req.Method, req.URL.Path, target.Root)
+
+	switch req.Method {
+	case `PUT`:
+		self.handlePut(w, req, target)
+	case `DELETE`:
+		self.handleDelete(w, req, target)
+	case `MKCOL`:
+		self.handleMkcol(w, req, target)
+	default:
+		lockSystem, _ := davLockSystems.LoadOrStore(target.Root, webdav.NewMemLS())
+
+		(&webdav.Handler{
+			Prefix: target.Prefix,
+			FileSystem: writableFileSystem{
+				Dir:    webdav.Dir(target.Root),
+				target: target,
+			},
+			LockSystem: lockSystem.(webdav.LockSystem),
+			Logger: func(req *http.Request, err error) {
+				if err != nil {
+					log.Warningf("webdav %v %v: %v", req.Method, req.URL.Path, err)
+				}
+			},
+		}).ServeHTTP(w, req)
+	}
+}
+
+// Write the request body to a temporary file alongside the destination, then atomically replace
+// the destination with it.
+func (self *Server) handlePut(w http.ResponseWriter, req *http.Request, target *writableTarget) {
+	filename, err := target.resolve(req.URL.Path)
+
+	if err != nil {
+		self.respondError(w, err, http.StatusForbidden)
+		return
+	}
+
+	if req.ContentLength > target.maxSize() {
+		self.respondError(w, fmt.Errorf("request body exceeds %d bytes", target.maxSize()), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if stat, err := os.Stat(filepath.Dir(filename)); err != nil || !stat.IsDir() {
+		self.respondError(w, fmt.Errorf("parent directory does not exist"), http.StatusConflict)
+		return
+	}
+
+	var existed bool
+
+	if stat, err := os.Stat(filename); err == nil {
+		if stat.IsDir() {
+			self.respondError(w, fmt.Errorf("%q is a directory", req.URL.Path), http.StatusMethodNotAllowed)
+			return
+		}
+
+		existed = true
+	}
+
+	if tmp, err := ioutil.TempFile(filepath.Dir(filename), `.diecast-upload-`); err == nil {
+		defer os.Remove(tmp.Name())
+
+		_, err := io.Copy(tmp, http.MaxBytesReader(w, req.Body, target.maxSize()))
+
+		if err == nil {
+			err = tmp.Sync()
+		}
+
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			if strings.Contains(err.Error(), `too large`) {
+				self.respondError(w, err, http.StatusRequestEntityTooLarge)
+			} else {
+				self.respondError(w, err, http.StatusInternalServerError)
+			}
+
+			return
+		}
+
+		if err := os.Chmod(tmp.Name(), 0644); err != nil {
+			self.respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		if err := os.Rename(tmp.Name(), filename); err != nil {
+			self.respondError(w, err, http.StatusInternalServerError)
+			return
+		}
+	} else {
+		self.respondError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (self *Server) handleDelete(w http.ResponseWriter, req *http.Request, target *writableTarget) {
+	filename, err := target.resolve(req.URL.Path)
+
+	if err != nil {
+		self.respondError(w, err, http.StatusForbidden)
+		return
+	}
+
+	if root, err := filepath.Abs(target.Root); err != nil || root == filename {
+		self.respondError(w, fmt.Errorf("cannot delete the root directory"), http.StatusForbidden)
+		return
+	}
+
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		self.respondError(w, fmt.Errorf("File %q was not found.", req.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	if err := os.RemoveAll(filename); err == nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		self.respondError(w, err, http.StatusInternalServerError)
+	}
+}
+
+func (self *Server) handleMkcol(w http.ResponseWriter, req *http.Request, target *writableTarget) {
+	filename, err := target.resolve(req.URL.Path)
+
+	if err != nil {
+		self.respondError(w, err, http.StatusForbidden)
+		return
+	}
+
+	if req.ContentLength > 0 {
+		self.respondError(w, fmt.Errorf("MKCOL request bodies are not supported"), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if _, err := os.Stat(filename); err == nil {
+		self.respondError(w, fmt.Errorf("%q already exists", req.URL.Path), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := os.Mkdir(filename, 0755); err == nil {
+		w.WriteHeader(http.StatusCreated)
+	} else if os.IsNotExist(err) {
+		self.respondError(w, fmt.Errorf("parent directory does not exist"), http.StatusConflict)
+	} else {
+		self.respondError(w, err, http.StatusInternalServerError)
+	}
+}